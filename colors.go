@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	chart "github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
+)
+
+// Grafana's classic series colors, assigned in order to a panel's series
+var GRAFANA_COLORS = []string{
+	"#7EB26D", "#EAB839", "#6ED0E0", "#EF843C", "#E24D42", "#1F78C1", "#BA43A9", "#705DA0",
+	"#508642", "#CCA300", "#447EBC", "#C15C17", "#890F02", "#0A437C", "#6D1F62", "#584477",
+	"#B7DBAB", "#F4D598", "#70DBED", "#F9BA8F", "#F29191", "#82B5D8", "#E5A8E2", "#AEA2E0",
+	"#629E51", "#E5AC0E", "#64B0C8", "#E0752D", "#BF1B00", "#0A50A1", "#962D82", "#614D93",
+	"#9AC48A", "#F2C96D", "#65C5DB", "#F9934E", "#EA6460", "#5195CE", "#D683CE", "#806EB7",
+	"#3F6833", "#967302", "#2F575E", "#99440A", "#58140C", "#052B51", "#511749", "#3F2B5B",
+	"#E0F9D7", "#FCEACA", "#CFFAFF", "#F9E2D2", "#FCE2DE", "#BADFF4", "#F9D9F9", "#DEDAF7",
+}
+
+// Names that Grafana 7+ saves instead of hex codes
+var GRAFANA_NAMED_COLORS = map[string]string{
+	"super-light-red": "#FFA6B0", "light-red": "#FF7383", "red": "#F2495C",
+	"semi-dark-red": "#E02F44", "dark-red": "#C4162A",
+	"super-light-orange": "#FFCB7D", "light-orange": "#FFB357", "orange": "#FF9830",
+	"semi-dark-orange": "#FF780A", "dark-orange": "#FA6400",
+	"super-light-yellow": "#FFF899", "light-yellow": "#FFEE52", "yellow": "#FADE2A",
+	"semi-dark-yellow": "#F2CC0C", "dark-yellow": "#E0B400",
+	"super-light-green": "#C8F2C2", "light-green": "#96D98D", "green": "#73BF69",
+	"semi-dark-green": "#56A64B", "dark-green": "#37872D",
+	"super-light-blue": "#C0D8FF", "light-blue": "#8AB8FF", "blue": "#5794F2",
+	"semi-dark-blue": "#3274D9", "dark-blue": "#1F60C4",
+	"super-light-purple": "#DEB6F2", "light-purple": "#CA95E5", "purple": "#B877D9",
+	"semi-dark-purple": "#A352CC", "dark-purple": "#8F3BB8",
+	"white": "#FFFFFF", "black": "#000000", "gray": "#808080", "grey": "#808080",
+}
+
+var HEX_COLOR_PATTERN = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+var RGB_COLOR_PATTERN = regexp.MustCompile(
+	`^rgba?\(\s*(\d+)\s*,\s*(\d+)\s*,\s*(\d+)\s*(?:,\s*([\d.]+)\s*)?\)$`)
+
+func grafanaColor(index int) drawing.Color {
+	return drawing.ColorFromHex(GRAFANA_COLORS[index%len(GRAFANA_COLORS)][1:])
+}
+
+// Parses a color as Grafana saves it: #rgb, #rrggbb, rgb(), rgba() or a name
+func parseColor(color string) (drawing.Color, error) {
+	color = strings.TrimSpace(color)
+	switch strings.ToLower(color) {
+	case "text":
+		return chart.DefaultTextColor, nil
+	case "transparent":
+		// Not the zero Color, which go-chart takes to mean unset
+		return drawing.Color{R: 255, G: 255, B: 255, A: 0}, nil
+	}
+	if hex, ok := GRAFANA_NAMED_COLORS[strings.ToLower(color)]; ok {
+		color = hex
+	}
+
+	if HEX_COLOR_PATTERN.MatchString(color) {
+		return drawing.ColorFromHex(color[1:]), nil
+	}
+
+	match := RGB_COLOR_PATTERN.FindStringSubmatch(strings.ToLower(color))
+	if match == nil {
+		return drawing.Color{}, fmt.Errorf("Unknown color '%s'", color)
+	}
+	components := [3]uint8{}
+	for i := 0; i < 3; i++ {
+		value, err := strconv.Atoi(match[i+1])
+		if err != nil || value > 255 {
+			return drawing.Color{}, fmt.Errorf("Bad color '%s'", color)
+		}
+		components[i] = uint8(value)
+	}
+	alpha := 1.0
+	if match[4] != "" {
+		var err error
+		alpha, err = strconv.ParseFloat(match[4], 64)
+		if err != nil || alpha > 1 {
+			return drawing.Color{}, fmt.Errorf("Bad alpha in color '%s'", color)
+		}
+	}
+	return drawing.Color{
+		R: components[0],
+		G: components[1],
+		B: components[2],
+		A: uint8(alpha * 255),
+	}, nil
+}
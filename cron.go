@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var CRON_SHORTHANDS = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var CRON_MONTH_NAMES = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var CRON_DAY_NAMES = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// A parsed five-field cron expression (minute hour day-of-month month
+// day-of-week); each field is a bitset of the values it allows
+type CronSchedule struct {
+	minutes     uint64
+	hours       uint64
+	daysOfMonth uint64
+	months      uint64
+	daysOfWeek  uint64
+	// Like cron, if both day fields are restricted a day matching either
+	// runs; a field starting with * (e.g. */2) counts as unrestricted
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+	location      *time.Location
+}
+
+func parseCronSchedule(expr string, location *time.Location) (*CronSchedule, error) {
+	if shorthand, ok := CRON_SHORTHANDS[strings.TrimSpace(expr)]; ok {
+		expr = shorthand
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Expected 5 fields in cron expression '%s' but got %d",
+			expr, len(fields))
+	}
+
+	schedule := &CronSchedule{
+		anyDayOfMonth: strings.HasPrefix(fields[2], "*"),
+		anyDayOfWeek:  strings.HasPrefix(fields[4], "*"),
+		location:      location,
+	}
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("Bad minute field: %s", err)
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("Bad hour field: %s", err)
+	}
+	if schedule.daysOfMonth, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("Bad day-of-month field: %s", err)
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12, CRON_MONTH_NAMES); err != nil {
+		return nil, fmt.Errorf("Bad month field: %s", err)
+	}
+	if schedule.daysOfWeek, err = parseCronField(fields[4], 0, 7, CRON_DAY_NAMES); err != nil {
+		return nil, fmt.Errorf("Bad day-of-week field: %s", err)
+	}
+	if schedule.daysOfWeek&(1<<7) != 0 { // 7 is another way to say Sunday
+		schedule.daysOfWeek |= 1 << 0
+	}
+	return schedule, nil
+}
+
+// Parses a comma-separated list of *, N, N-M, with optional /step
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart := part
+		step := 1
+		if slash := strings.Index(part, "/"); slash != -1 {
+			rangePart = part[:slash]
+			var err error
+			step, err = strconv.Atoi(part[slash+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("Bad step in '%s'", part)
+			}
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = parseCronValue(bounds[1], names); err != nil {
+					return 0, err
+				}
+			} else if step > 1 { // e.g. 5/15 means 5-max/15
+				high = max
+			}
+		}
+		if low < min || high > max {
+			return 0, fmt.Errorf("'%s' is outside %d-%d", part, min, max)
+		} else if low > high {
+			return 0, fmt.Errorf("Range '%s' is backwards", part)
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(s string, names map[string]int) (int, error) {
+	if value, ok := names[strings.ToLower(s)]; ok {
+		return value, nil
+	}
+	value, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("Bad value '%s'", s)
+	}
+	return value, nil
+}
+
+// The first time strictly after the given one that the schedule allows, or
+// the zero time if there's none within a few years (e.g. for Feb 30)
+func (schedule *CronSchedule) Next(after time.Time) time.Time {
+	t := after.In(schedule.location).Truncate(time.Minute).Add(time.Minute)
+	giveUp := t.AddDate(5, 0, 0)
+
+	for t.Before(giveUp) {
+		if schedule.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, schedule.location)
+			continue
+		}
+		if !schedule.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, schedule.location)
+			continue
+		}
+		if schedule.hours&(1<<uint(t.Hour())) == 0 {
+			// Adding rather than using time.Date avoids getting stuck on
+			// an hour that a DST change skips or repeats. Not Truncate,
+			// which would break zones with half-hour offsets.
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if schedule.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		if t.Add(-time.Hour).Hour() == t.Hour() {
+			// The second pass through an hour that a DST change repeats;
+			// like cron, only run in the first
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (schedule *CronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := schedule.daysOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := schedule.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if schedule.anyDayOfMonth || schedule.anyDayOfWeek {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("Error from LoadLocation: %s", err)
+	}
+	return location
+}
+
+func TestCronNext(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	date := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2021, month, day, hour, minute, 0, 0, newYork)
+	}
+	tests := []struct {
+		name     string
+		expr     string
+		after    time.Time
+		expected time.Time
+	}{
+		{"strictly after", "0 7 * * *", date(time.June, 1, 7, 0), date(time.June, 2, 7, 0)},
+		{"seconds are dropped", "* * * * *",
+			date(time.June, 1, 7, 0).Add(30 * time.Second), date(time.June, 1, 7, 1)},
+		{"hourly", "@hourly", date(time.June, 1, 7, 10), date(time.June, 1, 8, 0)},
+		{"list and range", "15,45 9-17 * * *", date(time.June, 1, 17, 50),
+			date(time.June, 2, 9, 15)},
+		{"step", "*/20 * * * *", date(time.June, 1, 7, 41), date(time.June, 1, 8, 0)},
+		{"start/step", "5/20 * * * *", date(time.June, 1, 7, 26), date(time.June, 1, 7, 45)},
+		{"day names", "30 8 * * mon", date(time.June, 1, 9, 0), date(time.June, 7, 8, 30)},
+		{"day name range", "0 9 * * MON-FRI", date(time.June, 4, 10, 0),
+			date(time.June, 7, 9, 0)},
+		{"7 is Sunday", "0 0 * * 7", date(time.June, 1, 0, 0), date(time.June, 6, 0, 0)},
+		{"month names", "0 0 1 jan,jul *", date(time.June, 1, 0, 0), date(time.July, 1, 0, 0)},
+		{"day of month or week", "0 0 13 * fri", date(time.June, 1, 0, 0),
+			date(time.June, 4, 0, 0)},
+		{"both restricted, month day first", "0 0 3 * fri", date(time.June, 1, 0, 0),
+			date(time.June, 3, 0, 0)},
+		// */2 counts as unrestricted, so it and Friday must both match
+		{"*/N day of month and day of week", "0 0 */2 * fri", date(time.June, 1, 0, 0),
+			date(time.June, 11, 0, 0)},
+		{"day of month and */N day of week", "0 0 13 * */2", date(time.June, 1, 0, 0),
+			date(time.June, 13, 0, 0)},
+		{"31st skips short months", "0 0 31 * *", date(time.June, 1, 0, 0),
+			date(time.July, 31, 0, 0)},
+
+		// Clocks in New York went from 2:00 EST to 3:00 EDT on March 14
+		// 2021, and from 2:00 EDT back to 1:00 EST on November 7
+		{"hour skipped by DST", "30 2 * * *", date(time.March, 13, 3, 0),
+			date(time.March, 15, 2, 30)},
+		{"hour after the skip", "30 3 * * *", date(time.March, 14, 0, 0),
+			date(time.March, 14, 3, 30)},
+		{"hourly over the skip", "0 * * * *", date(time.March, 14, 1, 0),
+			date(time.March, 14, 3, 0)},
+		{"repeated hour runs once", "30 1 * * *", date(time.November, 7, 1, 30),
+			date(time.November, 8, 1, 30)},
+		{"first pass of a repeated hour", "30 1 * * *", date(time.November, 7, 0, 0),
+			date(time.November, 7, 1, 30)},
+		{"daily over the repeat", "0 7 * * *", date(time.November, 6, 7, 0),
+			date(time.November, 7, 7, 0)},
+	}
+	for _, test := range tests {
+		schedule, err := parseCronSchedule(test.expr, newYork)
+		if err != nil {
+			t.Errorf("%s: error from parseCronSchedule: %s", test.name, err)
+			continue
+		}
+		actual := schedule.Next(test.after)
+		if !actual.Equal(test.expected) {
+			t.Errorf("%s: Next(%s) of '%s' = %s, expected %s",
+				test.name, test.after, test.expr, actual, test.expected)
+		}
+	}
+}
+
+func TestCronNextInUtcFromOtherZone(t *testing.T) {
+	schedule, err := parseCronSchedule("0 7 * * *", mustLoadLocation(t, "America/New_York"))
+	if err != nil {
+		t.Fatalf("Error from parseCronSchedule: %s", err)
+	}
+	// 7:00 in New York is 11:00 UTC in the summer
+	actual := schedule.Next(time.Date(2021, time.June, 1, 10, 0, 0, 0, time.UTC))
+	expected := time.Date(2021, time.June, 1, 11, 0, 0, 0, time.UTC)
+	if !actual.Equal(expected) {
+		t.Errorf("Expected %s but got %s", expected, actual)
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	schedule, err := parseCronSchedule("0 0 30 feb *", time.UTC)
+	if err != nil {
+		t.Fatalf("Error from parseCronSchedule: %s", err)
+	}
+	if next := schedule.Next(time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)); !next.IsZero() {
+		t.Errorf("Expected no next run but got %s", next)
+	}
+}
+
+func TestParseCronScheduleErrors(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"* * * *", "Expected 5 fields"},
+		{"@fortnightly", "Expected 5 fields"},
+		{"60 * * * *", "Bad minute field: '60' is outside 0-59"},
+		{"* 24 * * *", "Bad hour field"},
+		{"* * 0 * *", "Bad day-of-month field"},
+		{"* * * 13 *", "Bad month field"},
+		{"* * * * 8", "Bad day-of-week field"},
+		{"5-1 * * * *", "Range '5-1' is backwards"},
+		{"*/0 * * * *", "Bad step in '*/0'"},
+		{"* * * foo *", "Bad value 'foo'"},
+	}
+	for _, test := range tests {
+		_, err := parseCronSchedule(test.expr, time.UTC)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("'%s': expected error containing %q but got %v", test.expr, test.expected, err)
+		}
+	}
+}
@@ -5,63 +5,398 @@ import (
 	"encoding/json"
 	"io"
 	"log"
+	"sort"
+	"strconv"
 )
 
+const MAX_DASHBOARD_JSON_BYTES = 16 * 1024 * 1024
+
+// Grafana 5's schemaVersion, which replaced rows with gridPos-positioned
+// panels
+const PANELS_SCHEMA_VERSION = 16
+
 type Dashboard struct {
-	Title string `json:"title"`
-	Rows  []Row  `json:"rows"`
+	Uid           string     `json:"uid"`
+	Title         string     `json:"title"`
+	Description   string     `json:"description"`
+	Tags          []string   `json:"tags"`
+	SchemaVersion int        `json:"schemaVersion"`
+	Rows          []Row      `json:"rows"`
+	Panels        []Panel    `json:"panels"` // Grafana 5+; see normalize
+	Templating    Templating `json:"templating"`
+	Time          TimeJson   `json:"time"`
+}
+
+type TimeJson struct {
+	From string `json:"from"`
+	To   string `json:"to"`
 }
 
 type Row struct {
-	Panels []Panel `json:"panels"`
+	Title       string  `json:"title"`
+	ShowTitle   bool    `json:"showTitle"`
+	Panels      []Panel `json:"panels"`
+	Repeat      string  `json:"repeat"`      // variable to repeat the row for
+	RepeatRowId int     `json:"repeatRowId"` // set on copies Grafana saved
 }
 
 type Panel struct {
-	Title      string   `json:"title"`
-	Targets    []Target `json:"targets"`
-	DataSource string   `json:"datasource"`
-	YAxes      []YAxis  `json:"yaxes"`
+	Type        string        `json:"type"`
+	Title       string        `json:"title"`
+	Description string        `json:"description"`
+	Targets     []Target      `json:"targets"`
+	DataSource  DataSourceRef `json:"datasource"`
+	YAxes       []YAxis       `json:"yaxes"`
+	Interval    string        `json:"interval"`
+	GridPos     GridPos       `json:"gridPos"`
+	Repeat      string        `json:"repeat"` // variable to repeat the panel for
+
+	// Graph options; nil means Grafana's default
+	Fill          *int    `json:"fill"` // opacity of the area under lines, 0-10
+	Linewidth     *int    `json:"linewidth"`
+	Lines         *bool   `json:"lines"`
+	Bars          bool    `json:"bars"`
+	Points        bool    `json:"points"`
+	Pointradius   float64 `json:"pointradius"`
+	Stack         bool    `json:"stack"`
+	Percentage    bool    `json:"percentage"` // only applies when stacked
+	SteppedLine   bool    `json:"steppedLine"`
+	NullPointMode string  `json:"nullPointMode"` // connected, null or "null as zero"
+
+	AliasColors     map[string]string `json:"aliasColors"` // series name to color
+	SeriesOverrides []SeriesOverride  `json:"seriesOverrides"`
+
+	// Singlestat options
+	ValueName       string          `json:"valueName"` // current, avg, max, min, total, delta...
+	Prefix          string          `json:"prefix"`
+	Postfix         string          `json:"postfix"`
+	Format          string          `json:"format"` // unit; see the units package
+	Decimals        NumberString    `json:"decimals"`
+	Thresholds      json.RawMessage `json:"thresholds"` // e.g. "50,80"; graphs save a list
+	Colors          []string        `json:"colors"`     // one more than thresholds
+	ColorValue      bool            `json:"colorValue"`
+	ColorBackground bool            `json:"colorBackground"`
+	ValueMaps       []ValueMap      `json:"valueMaps"`
+	RangeMaps       []RangeMap      `json:"rangeMaps"`
+	MappingType     int             `json:"mappingType"` // 1 for valueMaps, 2 for rangeMaps
+	Sparkline       Sparkline       `json:"sparkline"`
+
+	// Grafana 7+ stat options
+	Options     PanelOptions `json:"options"`
+	FieldConfig FieldConfig  `json:"fieldConfig"`
+
+	// Table options
+	Transform string        `json:"transform"` // e.g. timeseries_to_rows
+	Columns   []TableColumn `json:"columns"`   // for timeseries_aggregations
+	Styles    []ColumnStyle `json:"styles"`
+	Sort      TableSort     `json:"sort"`
+
+	// Set on copies of repeated panels that Grafana saved; we make our own
+	RepeatPanelId int `json:"repeatPanelId"`
+
+	// For panels of type "row" in Grafana 5+ dashboards; a collapsed row
+	// keeps its panels here instead of after it in the dashboard's panels
+	Collapsed bool    `json:"collapsed"`
+	Panels    []Panel `json:"panels"`
+}
+
+// Changes to how the series matching Alias, a name or /regex/, are drawn;
+// fields left out don't change anything
+type SeriesOverride struct {
+	Alias        string `json:"alias"`
+	Color        string `json:"color"`
+	Fill         *int   `json:"fill"`
+	Linewidth    *int   `json:"linewidth"`
+	Yaxis        int    `json:"yaxis"` // 2 for the right y axis
+	HiddenSeries *bool  `json:"hiddenSeries"`
+	Transform    string `json:"transform"` // negative-Y draws the series upside down
+}
+
+type ValueMap struct {
+	Value NumberString `json:"value"` // or "null"
+	Text  string       `json:"text"`
+}
+
+type RangeMap struct {
+	From NumberString `json:"from"`
+	To   NumberString `json:"to"`
+	Text string       `json:"text"`
+}
+
+type Sparkline struct {
+	Show      bool   `json:"show"`
+	Full      bool   `json:"full"` // fill the whole tile rather than the bottom
+	LineColor string `json:"lineColor"`
+	FillColor string `json:"fillColor"`
+}
+
+type PanelOptions struct {
+	ReduceOptions ReduceOptions `json:"reduceOptions"`
+	GraphMode     string        `json:"graphMode"` // area or none
+	ColorMode     string        `json:"colorMode"` // value, background or none
+}
+
+// Panel plugins put anything in options, so ones that don't parse are
+// ignored rather than failing the dashboard
+func (options *PanelOptions) UnmarshalJSON(data []byte) error {
+	type plain PanelOptions
+	var parsed plain
+	if err := json.Unmarshal(data, &parsed); err == nil {
+		*options = PanelOptions(parsed)
+	}
+	return nil
+}
+
+type ReduceOptions struct {
+	Calcs []string `json:"calcs"` // e.g. lastNotNull or mean
+}
+
+type FieldConfig struct {
+	Defaults FieldDefaults `json:"defaults"`
+}
+
+func (config *FieldConfig) UnmarshalJSON(data []byte) error {
+	type plain FieldConfig
+	var parsed plain
+	if err := json.Unmarshal(data, &parsed); err == nil {
+		*config = FieldConfig(parsed)
+	}
+	return nil
+}
+
+type FieldDefaults struct {
+	Unit       string            `json:"unit"`
+	Decimals   NumberString      `json:"decimals"`
+	Thresholds ThresholdsConfig  `json:"thresholds"`
+	Mappings   []json.RawMessage `json:"mappings"` // formats differ in Grafana 7 and 8
+}
+
+type ThresholdsConfig struct {
+	Steps []ThresholdStep `json:"steps"`
+}
+
+type ThresholdStep struct {
+	Color string   `json:"color"`
+	Value *float64 `json:"value"` // nil for the base step
+}
+
+// An aggregation to show as a column, e.g. {"text": "Avg", "value": "avg"}
+type TableColumn struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+// How to show the table columns matching Pattern, a name or /regex/
+type ColumnStyle struct {
+	Pattern    string         `json:"pattern"`
+	Alias      string         `json:"alias"`
+	Type       string         `json:"type"` // number, string, date or hidden
+	Unit       string         `json:"unit"`
+	Decimals   NumberString   `json:"decimals"`
+	DateFormat string         `json:"dateFormat"` // e.g. YYYY-MM-DD HH:mm:ss
+	Thresholds []NumberString `json:"thresholds"`
+	Colors     []string       `json:"colors"`
+	ColorMode  string         `json:"colorMode"` // cell, value or row; blank for none
+}
+
+type TableSort struct {
+	Col  *int `json:"col"` // nil for unsorted
+	Desc bool `json:"desc"`
+}
+
+// Other panel types may use sort for something else
+func (sort *TableSort) UnmarshalJSON(data []byte) error {
+	type plain TableSort
+	var parsed plain
+	if err := json.Unmarshal(data, &parsed); err == nil {
+		*sort = TableSort(parsed)
+	}
+	return nil
+}
+
+type GridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// A datasource name, or since Grafana 8 an object with its uid
+type DataSourceRef string
+
+func (ref *DataSourceRef) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*ref = DataSourceRef(name)
+		return nil
+	}
+
+	var object struct {
+		Uid string `json:"uid"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	*ref = DataSourceRef(object.Uid)
+	return nil
 }
 
 type Target struct {
 	DsType      string     `json:"dsType"`
+	RawQuery    bool       `json:"rawQuery"`
 	Query       string     `json:"query"`
 	Selects     [][]Select `json:"select"`
 	Measurement string     `json:"measurement"`
+	Policy      string     `json:"policy"` // retention policy
 	Tags        []Tag      `json:"tags"`
 	GroupBys    []GroupBy  `json:"groupBy"`
+	Alias       string     `json:"alias"`
+
+	// Prometheus
+	Expr           string `json:"expr"`
+	LegendFormat   string `json:"legendFormat"`
+	Interval       string `json:"interval"`
+	IntervalFactor int    `json:"intervalFactor"`
 }
 
 type Select struct {
-	Params []string `json:"params"`
-	Type   string   `json:"type"`
+	Params QueryParams `json:"params"`
+	Type   string      `json:"type"`
 }
 
 type YAxis struct {
-	Min string `json:"min"`
-	Max string `json:"max"`
+	Min      NumberString `json:"min"`
+	Max      NumberString `json:"max"`
+	LogBase  int          `json:"logBase"` // 1 for a linear scale
+	Label    string       `json:"label"`
+	Format   string       `json:"format"` // unit, e.g. bytes; see the units package
+	Decimals *int         `json:"decimals"`
+}
+
+// Grafana saves axis limits as strings, but newer versions as numbers
+type NumberString string
+
+func (number *NumberString) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*number = NumberString(s)
+		return nil
+	}
+	var f *float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	if f == nil {
+		*number = ""
+	} else {
+		*number = NumberString(strconv.FormatFloat(*f, 'f', -1, 64))
+	}
+	return nil
 }
 
 type Tag struct {
-	Key      string `json:"key"`
-	Operator string `json:"operator"`
-	Value    string `json:"value"`
+	Key       string `json:"key"`
+	Operator  string `json:"operator"`
+	Value     string `json:"value"`
+	Condition string `json:"condition"` // AND or OR with the tag before
 }
 
 type GroupBy struct {
-	Params []string `json:"params"`
-	Type   string   `json:"type"`
+	Params QueryParams `json:"params"`
+	Type   string      `json:"type"`
+}
+
+// Grafana saves query part params as strings, but some as numbers, e.g.
+// {"type": "percentile", "params": [95]}
+type QueryParams []string
+
+func (params *QueryParams) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*params = make(QueryParams, len(raw))
+	for i, item := range raw {
+		var param string
+		if err := json.Unmarshal(item, &param); err == nil {
+			(*params)[i] = param
+		} else {
+			(*params)[i] = string(item)
+		}
+	}
+	return nil
+}
+
+type Templating struct {
+	List []TemplateVariable `json:"list"`
+}
+
+type TemplateVariable struct {
+	Name       string           `json:"name"`
+	Type       string           `json:"type"` // query, custom, constant, interval or textbox
+	Query      string           `json:"query"`
+	DataSource DataSourceRef    `json:"datasource"`
+	Regex      string           `json:"regex"`
+	Multi      bool             `json:"multi"`
+	IncludeAll bool             `json:"includeAll"`
+	AllValue   string           `json:"allValue"`
+	Options    []TemplateOption `json:"options"`
+	Current    TemplateCurrent  `json:"current"`
+
+	// For interval variables with an auto option
+	Auto      bool   `json:"auto"`
+	AutoCount int    `json:"auto_count"`
+	AutoMin   string `json:"auto_min"`
+}
+
+type TemplateOption struct {
+	Value TemplateValues `json:"value"`
+}
+
+type TemplateCurrent struct {
+	Value TemplateValues `json:"value"`
+}
+
+// Grafana saves the current value as a string, or as a list of strings
+// if the variable allows multiple values
+type TemplateValues []string
+
+func (values *TemplateValues) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*values = TemplateValues{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err == nil {
+		*values = TemplateValues(multiple)
+		return nil
+	}
+
+	// Tolerate numbers and booleans by keeping their JSON text
+	if string(data) == "null" {
+		*values = TemplateValues{}
+	} else {
+		*values = TemplateValues{string(data)}
+	}
+	return nil
 }
 
 func parseDashboardsJson(reader io.Reader) []Dashboard {
 	dashboards := []Dashboard{}
 	scanner := bufio.NewScanner(reader)
+	// Lines are whole dashboards, which can be far longer than the default
+	// 64KB limit
+	scanner.Buffer(make([]byte, 64*1024), MAX_DASHBOARD_JSON_BYTES)
 	for scanner.Scan() {
 		dashboard := Dashboard{}
 		err := json.Unmarshal(scanner.Bytes(), &dashboard)
 		if err != nil {
 			log.Fatalf("Error from Unmarshal: %s", err)
 		}
+		dashboard.normalize()
 		dashboards = append(dashboards, dashboard)
 	}
 
@@ -71,3 +406,62 @@ func parseDashboardsJson(reader io.Reader) []Dashboard {
 
 	return dashboards
 }
+
+// Converts the Grafana 5+ layout, a flat list of panels positioned by
+// gridPos in which each "row" panel starts a row, into Rows like older
+// dashboards have.  Panels above the first row go in an untitled row.
+func (dashboard *Dashboard) normalize() {
+	// Older schemas keep panels only in rows; without a schemaVersion, go by
+	// whether there are top-level panels
+	if dashboard.SchemaVersion == 0 {
+		if len(dashboard.Panels) == 0 {
+			return
+		}
+	} else if dashboard.SchemaVersion < PANELS_SCHEMA_VERSION {
+		return
+	}
+
+	rows := []Row{}
+	inRepeatedRowCopy := false
+	for _, panel := range sortByGridPos(dashboard.Panels) {
+		if panel.Type == "row" {
+			// Grafana saves copies of repeated rows; we make our own
+			inRepeatedRowCopy = panel.RepeatPanelId != 0
+			if inRepeatedRowCopy {
+				continue
+			}
+
+			row := Row{Title: panel.Title, ShowTitle: true, Repeat: panel.Repeat}
+			if panel.Collapsed {
+				row.Panels = sortByGridPos(panel.Panels)
+			}
+			rows = append(rows, row)
+		} else if !inRepeatedRowCopy {
+			if len(rows) == 0 {
+				rows = append(rows, Row{})
+			}
+			rows[len(rows)-1].Panels = append(rows[len(rows)-1].Panels, panel)
+		}
+	}
+
+	dashboard.Rows = append(dashboard.Rows, rows...)
+	dashboard.Panels = nil
+}
+
+// Orders panels top to bottom, then left to right, as Grafana shows them
+func sortByGridPos(panels []Panel) []Panel {
+	sorted := append([]Panel{}, panels...)
+	sort.Stable(panelsByGridPos(sorted))
+	return sorted
+}
+
+type panelsByGridPos []Panel
+
+func (panels panelsByGridPos) Len() int      { return len(panels) }
+func (panels panelsByGridPos) Swap(i, j int) { panels[i], panels[j] = panels[j], panels[i] }
+func (panels panelsByGridPos) Less(i, j int) bool {
+	if panels[i].GridPos.Y != panels[j].GridPos.Y {
+		return panels[i].GridPos.Y < panels[j].GridPos.Y
+	}
+	return panels[i].GridPos.X < panels[j].GridPos.X
+}
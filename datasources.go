@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	clientPkg "github.com/influxdata/influxdb/client/v2"
+)
+
+// One row of Grafana's data_source table, as exported by
+// get_grafana_config.sh or listed by Grafana's API
+type DataSource struct {
+	Uid               string             `json:"uid"`
+	Name              string             `json:"name"`
+	Type              string             `json:"type"`
+	Url               string             `json:"url"`
+	Database          string             `json:"database"`
+	User              string             `json:"user"`
+	Password          string             `json:"password"`
+	BasicAuth         bool               `json:"basic_auth"`
+	BasicAuthUser     string             `json:"basic_auth_user"`
+	BasicAuthPassword string             `json:"basic_auth_password"`
+	IsDefault         bool               `json:"is_default"`
+	JsonData          DataSourceJsonData `json:"json_data"`
+
+	influxdbClient clientPkg.Client
+	httpClient     *http.Client // for Prometheus
+	bearerToken    string       // sent instead of basic auth, through Grafana's proxy
+}
+
+// Datasources that dashboards name, and their InfluxDB databases, for running
+// without an exported datasources file
+var LEGACY_DATABASES = map[string]string{
+	"belugacdn_logs":     "mydb",
+	"InfluxDB: cadvisor": "cadvisor",
+}
+
+type DataSourceJsonData struct {
+	TimeInterval string `json:"timeInterval"`
+	DbName       string `json:"dbName"` // InfluxDB's database in newer Grafanas
+}
+
+type DataSources struct {
+	byName      map[string]*DataSource
+	byUid       map[string]*DataSource
+	defaultName string
+}
+
+// queryTimeout bounds each InfluxDB and Prometheus request, so a query
+// abandoned after -queryTimeout doesn't keep running against the server
+func NewDataSources(dataSourceList []DataSource, queryTimeout time.Duration) *DataSources {
+	dataSources := &DataSources{
+		byName: map[string]*DataSource{},
+		byUid:  map[string]*DataSource{},
+	}
+	for i := range dataSourceList {
+		dataSource := &dataSourceList[i]
+		if dataSource.Database == "" {
+			dataSource.Database = dataSource.JsonData.DbName
+		}
+
+		if dataSource.Type == "influxdb" {
+			username := dataSource.User
+			password := dataSource.Password
+			if dataSource.BasicAuth {
+				username = dataSource.BasicAuthUser
+				password = dataSource.BasicAuthPassword
+			}
+
+			client, err := clientPkg.NewHTTPClient(clientPkg.HTTPConfig{
+				Addr:     dataSource.Url,
+				Username: username,
+				Password: password,
+				Timeout:  queryTimeout,
+			})
+			if err != nil {
+				log.Fatalf("Error from NewHTTPClient for datasource '%s': %s",
+					dataSource.Name, err)
+			}
+			dataSource.influxdbClient = client
+		} else if dataSource.Type == "prometheus" {
+			dataSource.httpClient = &http.Client{Timeout: queryTimeout}
+		}
+
+		dataSources.byName[dataSource.Name] = dataSource
+		if dataSource.Uid != "" {
+			dataSources.byUid[dataSource.Uid] = dataSource
+		}
+		if dataSource.IsDefault {
+			dataSources.defaultName = dataSource.Name
+		}
+	}
+	return dataSources
+}
+
+// Finds the datasource a panel refers to by name or uid; a blank name or
+// "default" means the default datasource
+func (dataSources *DataSources) Lookup(name string) (*DataSource, error) {
+	if name == "" || name == "default" {
+		if dataSources.defaultName == "" {
+			return nil, fmt.Errorf("No default datasource is configured")
+		}
+		name = dataSources.defaultName
+	}
+
+	dataSource, found := dataSources.byName[name]
+	if !found {
+		dataSource, found = dataSources.byUid[name]
+	}
+	if !found {
+		return nil, fmt.Errorf("Unknown datasource '%s'", name)
+	}
+	return dataSource, nil
+}
+
+func parseDataSourcesJson(reader io.Reader, queryTimeout time.Duration) *DataSources {
+	dataSourceList := []DataSource{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		dataSource := DataSource{}
+		err := json.Unmarshal(scanner.Bytes(), &dataSource)
+		if err != nil {
+			log.Fatalf("Error from Unmarshal: %s", err)
+		}
+		dataSourceList = append(dataSourceList, dataSource)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Error from scanner.Err(): %s", err)
+	}
+
+	return NewDataSources(dataSourceList, queryTimeout)
+}
@@ -1,10 +1,11 @@
 #!/bin/bash -ex
 
-pushd $GOPATH/src/github.com/danielstutzman/prometheus-email-reports
-go vet .
-pushd
-
+# The tree builds in GOPATH mode against vendor/, with no go.mod
+export GO111MODULE=off
+pushd $GOPATH/src/github.com/danielstutzman/email-grafana-reports
+go vet . ./units/
 go install -race .
+popd
 
 fwknop -s -n monitoring.danstutzman.com
 ssh root@monitoring.danstutzman.com <<"EOF"
@@ -15,40 +16,59 @@ ssh root@monitoring.danstutzman.com <<"EOF"
   sudo chown prometheus-email-reports:prometheus-email-reports /home/prometheus-email-reports
   cd /home/prometheus-email-reports
 
-  GOROOT=/home/prometheus-email-reports/go1.7.3.linux-amd64
+  # Needs Go 1.15 or later, for errors.As and tls.Config.VerifyConnection
+  GOROOT=/home/prometheus-email-reports/go1.22.12.linux-amd64
   if [ ! -e $GOROOT ]; then
-    sudo curl https://storage.googleapis.com/golang/go1.7.3.linux-amd64.tar.gz >go1.7.3.linux-amd64.tar.gz
-    chown prometheus-email-reports:prometheus-email-reports go1.7.3.linux-amd64.tar.gz
-    sudo -u prometheus-email-reports tar xzf go1.7.3.linux-amd64.tar.gz
+    sudo curl -L https://go.dev/dl/go1.22.12.linux-amd64.tar.gz >go1.22.12.linux-amd64.tar.gz
+    chown prometheus-email-reports:prometheus-email-reports go1.22.12.linux-amd64.tar.gz
+    sudo -u prometheus-email-reports tar xzf go1.22.12.linux-amd64.tar.gz
     sudo -u prometheus-email-reports mv go $GOROOT
   fi
   GOPATH=/home/prometheus-email-reports/gopath
   sudo -u prometheus-email-reports mkdir -p $GOPATH
-  sudo -u prometheus-email-reports mkdir -p $GOPATH/src/github.com/danielstutzman/prometheus-email-reports
+  sudo -u prometheus-email-reports mkdir -p $GOPATH/src/github.com/danielstutzman/email-grafana-reports
 EOF
 
-time rsync -a -e "ssh -C" -r . root@monitoring.danstutzman.com:/home/prometheus-email-reports/gopath/src/github.com/danielstutzman/prometheus-email-reports --include='*.go' --include='*/' --exclude='*' --prune-empty-dirs --delete
+time rsync -a -e "ssh -C" -r . root@monitoring.danstutzman.com:/home/prometheus-email-reports/gopath/src/github.com/danielstutzman/email-grafana-reports --include='*.go' --include='*/' --exclude='*' --prune-empty-dirs --delete
 
 fwknop -s -n monitoring.danstutzman.com
 ssh root@monitoring.danstutzman.com <<"EOF"
   set -ex
 
-  GOROOT=/home/prometheus-email-reports/go1.7.3.linux-amd64
+  GOROOT=/home/prometheus-email-reports/go1.22.12.linux-amd64
   GOPATH=/home/prometheus-email-reports/gopath
-  cd $GOPATH/src/github.com/danielstutzman/prometheus-email-reports
+  cd $GOPATH/src/github.com/danielstutzman/email-grafana-reports
   chown -R prometheus-email-reports:prometheus-email-reports .
-  time sudo -u prometheus-email-reports GOPATH=$GOPATH GOROOT=$GOROOT $GOROOT/bin/go install -race
+  time sudo -u prometheus-email-reports GOPATH=$GOPATH GOROOT=$GOROOT GO111MODULE=off \
+    GOCACHE=/home/prometheus-email-reports/.cache/go-build $GOROOT/bin/go install -race .
 
   touch /var/log/prometheus-email-reports.log
   chown prometheus-email-reports:root /var/log/prometheus-email-reports.log
-  tee /etc/cron.d/prometheus-email-reports <<EOF2
-0 7 * * * prometheus-email-reports /home/prometheus-email-reports/gopath/bin/prometheus-email-reports -pngPath out.png -prometheusHostPort localhost:9090 -emailFrom "Reports <reports@monitoring.danstutzman.com>" -emailSubject "Report with Prometheus metrics" -emailTo dtstutz@gmail.com -smtpHostPort localhost:25 >> /var/log/prometheus-email-reports.log
+  rm -f /etc/cron.d/prometheus-email-reports
+  tee /etc/systemd/system/prometheus-email-reports.service <<EOF2
+[Unit]
+Description=Email Grafana reports on the schedules in reports.json
+After=network.target
+
+[Service]
+User=prometheus-email-reports
+WorkingDirectory=/home/prometheus-email-reports
+ExecStart=/home/prometheus-email-reports/gopath/bin/email-grafana-reports -serve -reportsConfigPath reports.json -stateFile state.json -grafanaUrl http://localhost:3000 -grafanaTokenFile grafana_token -emailFrom "Reports <reports@monitoring.danstutzman.com>" -smtpHostPort localhost:25
+Restart=on-failure
+StandardOutput=append:/var/log/prometheus-email-reports.log
+StandardError=append:/var/log/prometheus-email-reports.log
+
+[Install]
+WantedBy=multi-user.target
 EOF2
+  systemctl daemon-reload
+  systemctl enable prometheus-email-reports
+  systemctl restart prometheus-email-reports
 EOF
 
 cat <<EOF
-To test, run:
-su -l prometheus-email-reports
-cat /etc/cron.d/prometheus-email-reports # to see command to run
-exit
+Reports run on the schedules in /home/prometheus-email-reports/reports.json
+(see reports.example.json).  To check on them, run:
+systemctl status prometheus-email-reports
+tail /var/log/prometheus-email-reports.log
 EOF
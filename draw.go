@@ -1,92 +1,460 @@
 package main
 
 import (
+	"fmt"
 	"image"
 	"log"
 	"math"
 	"strconv"
 	"time"
 
+	"github.com/danielstutzman/email-grafana-reports/units"
+	"github.com/golang/freetype/truetype"
 	chart "github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
 )
 
-func drawChart(points [][]Point, yAxisTitle string,
-	xMin, xMax time.Time,
-	yMin, yMax string) image.Image {
+const CHART_WIDTH = 300
+const CHART_HEIGHT = 200
 
-	minXValue := float64(xMin.UnixNano())
-	maxXValue := float64(xMax.UnixNano())
-	minYValue := math.MaxFloat64
-	maxYValue := -math.MaxFloat64
-	serieses := []chart.Series{}
+// Space at the top of stat, table and message tiles for the panel's title
+const TILE_TITLE_HEIGHT = 50
 
-	for _, seriesPoints := range points {
-		xvalues := make([]float64, len(seriesPoints))
-		yvalues := make([]float64, len(seriesPoints))
-		for i, point := range seriesPoints {
-			xvalue := float64(point.Time.UnixNano())
-			xvalues[i] = xvalue
-
-			yvalue := point.Value
-			yvalues[i] = yvalue
-			if yvalue < minYValue {
-				minYValue = yvalue
-			}
-			if yvalue > maxYValue {
-				maxYValue = yvalue
-			}
-		}
-		if minYValue == maxYValue {
-			minYValue = 0
-		}
-		series := chart.ContinuousSeries{XValues: xvalues, YValues: yvalues}
-		serieses = append(serieses, series)
+// The legend goes below the chart, one series per line, making the image
+// taller; go-chart's legend spaces lines by its minimum tick spacing
+const LEGEND_LINE_HEIGHT = chart.DefaultMinimumTickVerticalSpacing + 10
+const LEGEND_PADDING = 5
+const LEGEND_FONT_SIZE = 8.0
+const LEGEND_MAX_LINES = 8
+
+// Draws a graph panel's series, the way its graph options say to
+func drawChart(allSeries []Series, panel Panel, xMin, xMax time.Time) (image.Image, error) {
+	graphs := toGraphSeries(allSeries, panel)
+	if len(graphs) == 0 {
+		return drawMessageTile(panel.Title, "every series is hidden")
 	}
 
-	if yMin != "" {
-		var err error
-		minYValue, err = strconv.ParseFloat(yMin, 64)
-		if err != nil {
-			log.Fatalf("Error from ParseFloat for yMin '%s'", yMin)
-		}
+	hasLeft, hasRight := false, false
+	for _, series := range graphs {
+		hasLeft = hasLeft || !series.options.rightYAxis
+		hasRight = hasRight || series.options.rightYAxis
+	}
+	leftAxis, err := chartYAxis(graphs, panel, false)
+	if err != nil {
+		return nil, err
+	}
+	rightAxis, err := chartYAxis(graphs, panel, true)
+	if err != nil {
+		return nil, err
 	}
 
-	if yMax != "" {
-		var err error
-		maxYValue, err = strconv.ParseFloat(yMax, 64)
-		if err != nil {
-			log.Fatalf("Error from ParseFloat for yMax '%s'", yMax)
+	// go-chart draws its primary y axis on the right, so with series on
+	// both sides Grafana's left axis becomes go-chart's secondary one
+	serieses := []chart.Series{}
+	for _, series := range graphs {
+		if hasLeft && hasRight && !series.options.rightYAxis {
+			series.yAxis = chart.YAxisSecondary
 		}
+		serieses = append(serieses, series)
 	}
 
 	graph := chart.Chart{
-		Title:      yAxisTitle,
+		Title:      panel.Title,
 		TitleStyle: chart.StyleShow(),
-		Width:      300,
-		Height:     200,
+		Width:      CHART_WIDTH,
+		Height:     CHART_HEIGHT,
 		XAxis: chart.XAxis{
-			Style:          chart.StyleShow(),
-			Range:          &chart.ContinuousRange{Min: minXValue, Max: maxXValue},
+			Style: chart.StyleShow(),
+			Range: &chart.ContinuousRange{
+				Min: float64(xMin.UnixNano()),
+				Max: float64(xMax.UnixNano()),
+			},
 			ValueFormatter: chart.TimeHourValueFormatter,
 		},
-		YAxis: chart.YAxis{
-			Name:      yAxisTitle,
-			NameStyle: chart.StyleShow(),
-			Style:     chart.StyleShow(),
-			Range:     &chart.ContinuousRange{Min: minYValue, Max: maxYValue},
-		},
+		YAxis:  leftAxis,
 		Series: serieses,
 	}
+	if hasLeft && hasRight {
+		graph.YAxis = rightAxis
+		graph.YAxisSecondary = leftAxis
+	} else if hasRight {
+		graph.YAxis = rightAxis
+	}
+
+	legendLines := numLegendLines(serieses)
+	if legendLines > 0 {
+		legendHeight := legendLines*LEGEND_LINE_HEIGHT + 2*LEGEND_PADDING +
+			chart.DefaultBackgroundPadding.Bottom
+		graph.Height += legendHeight
+		graph.Background.Padding = chart.DefaultBackgroundPadding
+		graph.Background.Padding.Bottom += legendHeight
+		graph.Elements = []chart.Renderable{drawLegend(&graph, graph.Height-legendHeight)}
+	}
 
 	imageWriter := &chart.ImageWriter{}
-	err := graph.Render(chart.PNG, imageWriter)
+	err = graph.Render(chart.PNG, imageWriter)
 	if err != nil {
-		log.Fatalf("Error from graph.Render: %s", err)
+		return nil, fmt.Errorf("Error from graph.Render: %s", err)
 	}
 
 	chartImage, err := imageWriter.Image()
 	if err != nil {
-		log.Fatalf("Error from imageWriter.Image(): %s", err)
+		return nil, fmt.Errorf("Error from imageWriter.Image(): %s", err)
+	}
+	return chartImage, nil
+}
+
+// Sets up one of the panel's y axes, fitted to the values of the series on
+// it unless the panel sets the axis' min or max
+func chartYAxis(graphs []graphSeries, panel Panel, rightYAxis bool) (chart.YAxis, error) {
+	yAxis := YAxis{Format: "short"}
+	if rightYAxis && len(panel.YAxes) > 1 {
+		yAxis = panel.YAxes[1]
+	} else if !rightYAxis && len(panel.YAxes) > 0 {
+		yAxis = panel.YAxes[0]
+	}
+	logScale := yAxis.LogBase > 1
+
+	minYValue := math.MaxFloat64
+	maxYValue := -math.MaxFloat64
+	percentage := false
+	for _, series := range graphs {
+		if series.options.rightYAxis != rightYAxis {
+			continue
+		}
+		if min, max, ok := series.yExtent(logScale); ok {
+			minYValue = math.Min(minYValue, min)
+			maxYValue = math.Max(maxYValue, max)
+		}
+		percentage = percentage || series.options.percentage
+	}
+	if minYValue > maxYValue { // no series, or every point was null
+		minYValue, maxYValue = 0, 1
+		if logScale {
+			minYValue, maxYValue = 1, float64(yAxis.LogBase)
+		}
+	} else if logScale {
+		minYValue, maxYValue = logBounds(minYValue, maxYValue, float64(yAxis.LogBase))
+	} else if minYValue == maxYValue {
+		minYValue = math.Min(0, minYValue)
+		maxYValue = math.Max(0, maxYValue)
+		if minYValue == maxYValue {
+			maxYValue = 1
+		}
+	}
+	if percentage {
+		maxYValue = math.Max(maxYValue, 100)
+	}
+
+	if yAxis.Min != "" {
+		min, err := strconv.ParseFloat(string(yAxis.Min), 64)
+		if err != nil {
+			return chart.YAxis{}, fmt.Errorf("Error from ParseFloat for yMin '%s'", yAxis.Min)
+		}
+		if !logScale || min > 0 {
+			minYValue = min
+		}
+	}
+	if yAxis.Max != "" {
+		max, err := strconv.ParseFloat(string(yAxis.Max), 64)
+		if err != nil {
+			return chart.YAxis{}, fmt.Errorf("Error from ParseFloat for yMax '%s'", yAxis.Max)
+		}
+		maxYValue = max
+	}
+
+	decimals := -1
+	if yAxis.Decimals != nil {
+		decimals = *yAxis.Decimals
+	}
+	axis := chart.YAxis{
+		Name:           yAxis.Label,
+		NameStyle:      chart.StyleShow(),
+		Style:          chart.StyleShow(),
+		Range:          &chart.ContinuousRange{Min: minYValue, Max: maxYValue},
+		ValueFormatter: unitValueFormatter(yAxis.Format, decimals),
+	}
+	if logScale {
+		axis.Range = &LogRange{Min: minYValue, Max: maxYValue, Base: float64(yAxis.LogBase)}
+	}
+	return axis, nil
+}
+
+// Widens min and max out to powers of base, as Grafana does for log scales
+func logBounds(min, max, base float64) (float64, float64) {
+	min = math.Pow(base, math.Floor(math.Log(min)/math.Log(base)))
+	max = math.Pow(base, math.Ceil(math.Log(max)/math.Log(base)))
+	if min == max {
+		max *= base
+	}
+	return min, max
+}
+
+// A go-chart range for a log scale y axis, with a tick at each power of
+// Base. Min must be positive; values at or below it are drawn at Min.
+type LogRange struct {
+	Min    float64
+	Max    float64
+	Base   float64
+	Domain int
+}
+
+func (r LogRange) IsZero() bool {
+	return r.Min == 0 && r.Max == 0 && r.Domain == 0
+}
+
+func (r LogRange) GetMin() float64 {
+	return r.Min
+}
+
+func (r *LogRange) SetMin(min float64) {
+	r.Min = min
+}
+
+func (r LogRange) GetMax() float64 {
+	return r.Max
+}
+
+func (r *LogRange) SetMax(max float64) {
+	r.Max = max
+}
+
+func (r LogRange) GetDelta() float64 {
+	return r.Max - r.Min
+}
+
+func (r LogRange) GetDomain() int {
+	return r.Domain
+}
+
+func (r *LogRange) SetDomain(domain int) {
+	r.Domain = domain
+}
+
+func (r LogRange) String() string {
+	return fmt.Sprintf("LogRange [%.2f,%.2f] base %.0f => %d", r.Min, r.Max, r.Base, r.Domain)
+}
+
+func (r LogRange) Translate(value float64) int {
+	if value <= r.Min {
+		return 0
+	}
+	ratio := (math.Log(value) - math.Log(r.Min)) / (math.Log(r.Max) - math.Log(r.Min))
+	return int(math.Ceil(ratio * float64(r.Domain)))
+}
+
+// At most about 10 ticks, skipping powers if there are more
+func (r LogRange) GetTicks(renderer chart.Renderer, defaults chart.Style,
+	formatter chart.ValueFormatter) []chart.Tick {
+
+	first := math.Ceil(math.Log(r.Min)/math.Log(r.Base) - 1e-9)
+	last := math.Floor(math.Log(r.Max)/math.Log(r.Base) + 1e-9)
+	step := math.Max(1, math.Ceil((last-first+1)/10))
+	ticks := []chart.Tick{}
+	for power := first; power <= last; power += step {
+		value := math.Pow(r.Base, power)
+		ticks = append(ticks, chart.Tick{Value: value, Label: formatter(value)})
+	}
+	return ticks
+}
+
+// Draws a chart-sized tile with the panel title and a message, for panels
+// that can't be drawn as a chart
+func drawMessageTile(title, message string) (image.Image, error) {
+	return drawTile(title, message, chart.ColorBlack, chart.ColorLightGray)
+}
+
+// Draws a tile in place of a panel that failed, with the error in red. If
+// even that fails, logs why and returns nil; the report then shows the
+// panel's error as text.
+func drawErrorTile(title string, err error) image.Image {
+	tileImage, tileErr := drawTile(title, "Error: "+err.Error(), chart.ColorRed, chart.ColorRed)
+	if tileErr != nil {
+		log.Printf("Error drawing error tile for '%s': %s", title, tileErr)
+		return nil
+	}
+	return tileImage
+}
+
+func drawTile(title, message string,
+	messageColor, borderColor drawing.Color) (image.Image, error) {
+
+	renderer, font, err := newTile(title, CHART_HEIGHT, borderColor)
+	if err != nil {
+		return nil, err
+	}
+	drawWrappedText(renderer, message,
+		chart.Box{Top: 60, Left: 10, Right: CHART_WIDTH - 10, Bottom: CHART_HEIGHT - 10},
+		chart.Style{
+			Font:      font,
+			FontSize:  chart.DefaultFontSize,
+			FontColor: messageColor,
+			TextWrap:  chart.TextWrapWord,
+		})
+
+	return finishTile(renderer)
+}
+
+// Starts a white tile as wide as a chart, with a border and the title at
+// the top; the caller draws the rest below TILE_TITLE_HEIGHT, then calls
+// finishTile
+func newTile(title string, height int, borderColor drawing.Color) (chart.Renderer,
+	*truetype.Font, error) {
+
+	renderer, err := chart.PNG(CHART_WIDTH, height)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error from chart.PNG: %s", err)
+	}
+	renderer.SetDPI(chart.DefaultDPI)
+	font, err := chart.GetDefaultFont()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error from chart.GetDefaultFont: %s", err)
+	}
+
+	chart.Draw.Box(renderer,
+		chart.Box{Top: 0, Left: 0, Right: CHART_WIDTH - 1, Bottom: height - 1},
+		chart.Style{
+			FillColor:   drawing.ColorWhite,
+			StrokeColor: borderColor,
+			StrokeWidth: 1,
+		})
+	drawWrappedText(renderer, title,
+		chart.Box{Top: 10, Left: 10, Right: CHART_WIDTH - 10, Bottom: TILE_TITLE_HEIGHT},
+		chart.Style{
+			Font:      font,
+			FontSize:  chart.DefaultTitleFontSize,
+			FontColor: chart.ColorBlack,
+			TextWrap:  chart.TextWrapWord,
+		})
+	return renderer, font, nil
+}
+
+func finishTile(renderer chart.Renderer) (image.Image, error) {
+	imageWriter := &chart.ImageWriter{}
+	if err := renderer.Save(imageWriter); err != nil {
+		return nil, fmt.Errorf("Error from renderer.Save: %s", err)
+	}
+	tileImage, err := imageWriter.Image()
+	if err != nil {
+		return nil, fmt.Errorf("Error from imageWriter.Image(): %s", err)
+	}
+	return tileImage, nil
+}
+
+// Draws text word-wrapped and centered horizontally within box, dropping
+// any lines that don't fit
+func drawWrappedText(renderer chart.Renderer, text string, box chart.Box,
+	style chart.Style) {
+
+	style.WriteTextOptionsToRenderer(renderer)
+	defer renderer.ResetStyle()
+
+	lineHeight := int(style.FontSize * chart.DefaultDPI / 72 * 1.3)
+	lines := chart.Text.WrapFit(renderer, text, box.Width(), style)
+	for i, line := range lines {
+		y := box.Top + (i+1)*lineHeight
+		if y > box.Bottom {
+			break
+		}
+		x := box.Left + (box.Width()-renderer.MeasureText(line).Width())/2
+		renderer.Text(line, x, y)
+	}
+}
+
+// One line per series, up to LEGEND_MAX_LINES (the last of which says how
+// many more there are), or none if no series has a name
+func numLegendLines(serieses []chart.Series) int {
+	named := 0
+	for _, series := range serieses {
+		if series.GetName() != "" {
+			named += 1
+		}
+	}
+	if named == 0 {
+		return 0
+	}
+	if len(serieses) > LEGEND_MAX_LINES {
+		return LEGEND_MAX_LINES
+	}
+	return len(serieses)
+}
+
+// Draws go-chart's legend starting at y=top, below the x axis, rather than
+// over the top of the chart.  Names are shortened to fit the image, and
+// past LEGEND_MAX_LINES the last line says how many more series there are.
+func drawLegend(graph *chart.Chart, top int) chart.Renderable {
+	return func(renderer chart.Renderer, canvasBox chart.Box, defaults chart.Style) {
+		style := chart.Style{FontSize: LEGEND_FONT_SIZE}
+		style.InheritFrom(defaults).WriteTextOptionsToRenderer(renderer)
+		maxTextWidth := CHART_WIDTH - chart.DefaultBackgroundPadding.Right - canvasBox.Left -
+			2*LEGEND_PADDING - 30 // the sample of the line after the name
+
+		entries := []chart.Series{}
+		for i, series := range graph.Series {
+			if i == LEGEND_MAX_LINES-1 && len(graph.Series) > LEGEND_MAX_LINES {
+				entries = append(entries, legendEntry{
+					name: fmt.Sprintf("and %d more", len(graph.Series)-i),
+					// Not drawn, but not zero so go-chart doesn't pick a color
+					style: chart.Style{Show: true, StrokeColor: drawing.Color{R: 255, G: 255, B: 255}},
+				})
+				break
+			}
+			entries = append(entries, legendEntry{
+				name:  truncateToWidth(renderer, series.GetName(), maxTextWidth),
+				style: series.GetStyle(),
+			})
+		}
+
+		legendChart := chart.Chart{Series: entries}
+		chart.Legend(&legendChart, style)(renderer,
+			chart.Box{Top: top, Left: canvasBox.Left}, defaults)
+	}
+}
+
+// A series that only has a name and style, for the legend
+type legendEntry struct {
+	name  string
+	style chart.Style
+}
+
+func (entry legendEntry) GetName() string {
+	return entry.name
+}
+
+func (entry legendEntry) GetYAxis() chart.YAxisType {
+	return chart.YAxisPrimary
+}
+
+func (entry legendEntry) GetStyle() chart.Style {
+	return entry.style
+}
+
+func (entry legendEntry) Render(renderer chart.Renderer, canvasBox chart.Box,
+	xrange, yrange chart.Range, defaults chart.Style) {
+}
+
+// Shortens text with an ellipsis until it fits in width pixels
+func truncateToWidth(renderer chart.Renderer, text string, width int) string {
+	if renderer.MeasureText(text).Width() <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		truncated := string(runes) + "…"
+		if renderer.MeasureText(truncated).Width() <= width {
+			return truncated
+		}
+	}
+	return ""
+}
+
+// For an axis' tick labels
+func unitValueFormatter(unit string, decimals int) chart.ValueFormatter {
+	return func(v interface{}) string {
+		if value, ok := v.(float64); ok {
+			return units.Format(value, unit, decimals)
+		}
+		return chart.FloatValueFormatter(v)
 	}
-	return chartImage
 }
@@ -1,54 +1,318 @@
 package main
 
 import (
-	"github.com/scorredoira/email"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/mail"
 	"net/smtp"
+	"strings"
+	"time"
 )
 
-func sendMail(smtpServerAndPort, from, to, subject, body, chartPngPath string) {
-	log.Printf("Sending email through %s...", smtpServerAndPort)
+const SMTP_DIAL_TIMEOUT = 30 * time.Second
 
-	m := email.NewMessage(subject, body)
+type SmtpConfig struct {
+	HostPort string
 
-	address, err := (&mail.AddressParser{}).Parse(from)
-	if err != nil {
-		log.Fatalf("Error from AddressParser.Parse('%s'): %s", from, err)
+	// One of "", "plain", "login" or "cram-md5"
+	Auth     string
+	Username string
+	Password string
+
+	// One of "starttls" (use STARTTLS if the server offers it, even with a
+	// certificate that doesn't verify), "starttls-required", "implicit" (TLS
+	// from the start, as on port 465) or "none"; blank means implicit on
+	// port 465 and starttls otherwise
+	TLS                string
+	CAFile             string
+	InsecureSkipVerify bool
+}
+
+type Recipients struct {
+	To  []*mail.Address
+	Cc  []*mail.Address
+	Bcc []*mail.Address
+}
+
+// Parses comma-separated address lists, any of which may be blank
+func parseRecipients(to, cc, bcc string) (Recipients, error) {
+	recipients := Recipients{}
+	for _, list := range []struct {
+		name      string
+		value     string
+		addresses *[]*mail.Address
+	}{
+		{"To", to, &recipients.To},
+		{"Cc", cc, &recipients.Cc},
+		{"Bcc", bcc, &recipients.Bcc},
+	} {
+		if strings.TrimSpace(list.value) == "" {
+			continue
+		}
+		addresses, err := mail.ParseAddressList(list.value)
+		if err != nil {
+			return Recipients{}, fmt.Errorf("Bad %s address list '%s': %s",
+				list.name, list.value, err)
+		}
+		*list.addresses = addresses
+	}
+
+	if len(recipients.All()) == 0 {
+		return Recipients{}, fmt.Errorf("No recipients")
+	}
+	return recipients, nil
+}
+
+// To, Cc and Bcc together; the envelope recipients
+func (recipients Recipients) All() []*mail.Address {
+	all := []*mail.Address{}
+	all = append(all, recipients.To...)
+	all = append(all, recipients.Cc...)
+	all = append(all, recipients.Bcc...)
+	return all
+}
+
+// Formats addresses for a To or Cc header
+func formatAddressList(addresses []*mail.Address) string {
+	formatted := make([]string, len(addresses))
+	for i, address := range addresses {
+		formatted[i] = address.String()
+	}
+	return strings.Join(formatted, ", ")
+}
+
+type RejectedRecipient struct {
+	Address string
+	Err     error
+}
+
+// Returned by sendMail when the message was sent, but the server refused
+// some of the recipients
+type RejectedRecipientsError struct {
+	Rejected      []RejectedRecipient
+	NumRecipients int
+}
+
+func (err *RejectedRecipientsError) Error() string {
+	rejected := make([]string, len(err.Rejected))
+	for i, recipient := range err.Rejected {
+		rejected[i] = fmt.Sprintf("%s (%s)", recipient.Address, recipient.Err)
 	}
-	m.From = *address
+	return fmt.Sprintf("Server rejected %d of %d recipients: %s",
+		len(err.Rejected), err.NumRecipients, strings.Join(rejected, ", "))
+}
 
-	m.To = []string{to}
+// Sends one RCPT per address in recipients; if only some are rejected,
+// the message still goes to the rest and a *RejectedRecipientsError is
+// returned
+func sendMail(config SmtpConfig, from string, recipients Recipients,
+	message []byte) error {
 
-	if err := m.Attach(chartPngPath); err != nil {
-		log.Fatalf("Error from m.Attach: %s", err)
+	log.Printf("Sending email through %s...", config.HostPort)
+
+	address, err := (&mail.AddressParser{}).Parse(from)
+	if err != nil {
+		return fmt.Errorf("Error from AddressParser.Parse('%s'): %s", from, err)
 	}
 
-	c, err := smtp.Dial(smtpServerAndPort)
+	c, err := dialSmtp(config)
 	if err != nil {
-		log.Fatalf("Error from smtp.Dial('%s'): %s", smtpServerAndPort, err)
+		return err
 	}
-	if err = c.Mail(from); err != nil {
-		log.Fatalf("Error from c.Mail('%s'): %s", from, err)
+	defer c.Close()
+
+	if err = c.Mail(address.Address); err != nil {
+		return fmt.Errorf("Error from c.Mail('%s'): %s", address.Address, err)
 	}
-	if err = c.Rcpt(to); err != nil {
-		log.Fatalf("Error from c.Rcpt('%s'): %s", to, err)
+	all := recipients.All()
+	rejected := []RejectedRecipient{}
+	for _, recipient := range all {
+		if err = c.Rcpt(recipient.Address); err != nil {
+			log.Printf("Error from c.Rcpt('%s'): %s", recipient.Address, err)
+			rejected = append(rejected, RejectedRecipient{recipient.Address, err})
+		}
 	}
+	if len(rejected) == len(all) {
+		c.Quit()
+		return &RejectedRecipientsError{Rejected: rejected, NumRecipients: len(all)}
+	}
+
 	w, err := c.Data()
 	if err != nil {
-		log.Fatalf("Error from c.Data(): %s", err)
+		return fmt.Errorf("Error from c.Data(): %s", err)
 	}
-	_, err = w.Write([]byte(m.Bytes()))
+	_, err = w.Write(message)
 	if err != nil {
-		log.Fatalf("Error from w.Write(msg): %s", err)
+		return fmt.Errorf("Error from w.Write(msg): %s", err)
 	}
 	err = w.Close()
 	if err != nil {
-		log.Fatalf("Error from w.Close(): %s", err)
+		return fmt.Errorf("Error from w.Close(): %s", err)
 	}
 	err = c.Quit()
 	if err != nil {
-		log.Fatalf("Error from c.Quit(): %s", err)
+		return fmt.Errorf("Error from c.Quit(): %s", err)
 	}
 	log.Printf("Email sent.")
+
+	if len(rejected) > 0 {
+		return &RejectedRecipientsError{Rejected: rejected, NumRecipients: len(all)}
+	}
+	return nil
+}
+
+// Connects, sets up TLS and authenticates according to config
+func dialSmtp(config SmtpConfig) (*smtp.Client, error) {
+	host, port, err := net.SplitHostPort(config.HostPort)
+	if err != nil {
+		return nil, fmt.Errorf("Error from SplitHostPort('%s'): %s", config.HostPort, err)
+	}
+
+	tlsMode := config.TLS
+	if tlsMode == "" {
+		if port == "465" {
+			tlsMode = "implicit"
+		} else {
+			tlsMode = "starttls"
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error from ReadFile('%s'): %s", config.CAFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", config.CAFile)
+		}
+	}
+	if tlsMode == "starttls" && !config.InsecureSkipVerify {
+		warnOnUnverifiedCertificate(tlsConfig)
+	}
+
+	var conn net.Conn
+	if tlsMode == "implicit" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: SMTP_DIAL_TIMEOUT},
+			"tcp", config.HostPort, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", config.HostPort, SMTP_DIAL_TIMEOUT)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to %s: %s", config.HostPort, err)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error from smtp.NewClient('%s'): %s", config.HostPort, err)
+	}
+
+	if tlsMode == "starttls" || tlsMode == "starttls-required" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("Error from c.StartTLS: %s", err)
+			}
+		} else if tlsMode == "starttls-required" {
+			c.Close()
+			return nil, fmt.Errorf("%s doesn't support STARTTLS", config.HostPort)
+		}
+	}
+
+	if config.Auth != "" {
+		auth, err := smtpAuth(config, host)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("%s doesn't support AUTH", config.HostPort)
+		}
+		if err := c.Auth(auth); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("Error from c.Auth: %s", err)
+		}
+	}
+
+	return c, nil
+}
+
+// For opportunistic STARTTLS: verifies the server's certificate as usual,
+// but only logs a warning if it doesn't verify, since encrypting anyway is
+// better than falling back to plaintext, e.g. for a local relay with a
+// self-signed certificate
+func warnOnUnverifiedCertificate(tlsConfig *tls.Config) {
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+		options := x509.VerifyOptions{
+			DNSName:       tlsConfig.ServerName,
+			Roots:         tlsConfig.RootCAs,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, certificate := range state.PeerCertificates[1:] {
+			options.Intermediates.AddCert(certificate)
+		}
+		if _, err := state.PeerCertificates[0].Verify(options); err != nil {
+			log.Printf("Warning: using STARTTLS with %s even though its certificate doesn't verify: %s",
+				tlsConfig.ServerName, err)
+		}
+		return nil
+	}
+}
+
+func smtpAuth(config SmtpConfig, host string) (smtp.Auth, error) {
+	switch config.Auth {
+	case "plain":
+		return smtp.PlainAuth("", config.Username, config.Password, host), nil
+	case "login":
+		return &loginAuth{username: config.Username, password: config.Password}, nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(config.Username, config.Password), nil
+	default:
+		return nil, fmt.Errorf("Unknown SMTP auth '%s'; expected plain, login or cram-md5",
+			config.Auth)
+	}
+}
+
+// The LOGIN mechanism, which net/smtp doesn't provide; like PlainAuth, it
+// refuses to send the password unencrypted except to localhost
+type loginAuth struct {
+	username string
+	password string
+}
+
+func (auth *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" &&
+		server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (auth *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(auth.username), nil
+	case "password:":
+		return []byte(auth.password), nil
+	default:
+		return nil, fmt.Errorf("Unexpected LOGIN challenge '%s'", fromServer)
+	}
 }
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-process SMTP server that records what clients send; it rejects
+// RCPT for addresses containing "reject"
+type fakeSmtpServer struct {
+	listener    net.Listener
+	certificate tls.Certificate
+	startTls    bool // advertise STARTTLS
+	implicitTls bool // TLS from the start, as on port 465
+	auth        bool // advertise AUTH
+
+	mutex    sync.Mutex
+	commands []string
+	messages []string
+	tls      []bool // whether each message arrived over TLS
+}
+
+func newFakeSmtpServer(t *testing.T, certificate tls.Certificate, startTls, implicitTls,
+	auth bool) *fakeSmtpServer {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error from Listen: %s", err)
+	}
+	server := &fakeSmtpServer{
+		listener:    listener,
+		certificate: certificate,
+		startTls:    startTls,
+		implicitTls: implicitTls,
+		auth:        auth,
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeSmtpServer) Close() {
+	server.listener.Close()
+}
+
+func (server *fakeSmtpServer) HostPort() string {
+	return server.listener.Addr().String()
+}
+
+func (server *fakeSmtpServer) record(command string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.commands = append(server.commands, command)
+}
+
+func (server *fakeSmtpServer) Commands() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string{}, server.commands...)
+}
+
+func (server *fakeSmtpServer) Messages() ([]string, []bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string{}, server.messages...), append([]bool{}, server.tls...)
+}
+
+func (server *fakeSmtpServer) serve(conn net.Conn) {
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{server.certificate}}
+	isTls := server.implicitTls
+	if isTls {
+		conn = tls.Server(conn, tlsConfig)
+	}
+	defer func() { conn.Close() }()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	readLine := func() (string, bool) {
+		line, err := reader.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err == nil
+	}
+
+	reply("220 fake ESMTP")
+	for {
+		line, ok := readLine()
+		if !ok {
+			return
+		}
+		server.record(line)
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			extensions := []string{"fake"}
+			if server.startTls && !isTls {
+				extensions = append(extensions, "STARTTLS")
+			}
+			if server.auth {
+				extensions = append(extensions, "AUTH PLAIN LOGIN")
+			}
+			for i, extension := range extensions {
+				if i < len(extensions)-1 {
+					reply("250-" + extension)
+				} else {
+					reply("250 " + extension)
+				}
+			}
+		case command == "STARTTLS":
+			reply("220 ready")
+			tlsConn := tls.Server(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			reader = bufio.NewReader(conn)
+			isTls = true
+		case strings.HasPrefix(command, "AUTH PLAIN"):
+			reply("235 ok")
+		case command == "AUTH LOGIN":
+			for _, prompt := range []string{"Username:", "Password:"} {
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte(prompt)))
+				answer, ok := readLine()
+				if !ok {
+					return
+				}
+				server.record(answer)
+			}
+			reply("235 ok")
+		case strings.HasPrefix(command, "RCPT") && strings.Contains(line, "reject"):
+			reply("550 no such user")
+		case command == "DATA":
+			reply("354 go ahead")
+			message := []string{}
+			for {
+				line, ok := readLine()
+				if !ok {
+					return
+				}
+				if line == "." {
+					break
+				}
+				message = append(message, line)
+			}
+			server.mutex.Lock()
+			server.messages = append(server.messages, strings.Join(message, "\n"))
+			server.tls = append(server.tls, isTls)
+			server.mutex.Unlock()
+			reply("250 queued")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// A self-signed certificate for 127.0.0.1, and its PEM for a CA file
+func newTestCertificate(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error from GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake smtp"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error from CreateCertificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func writeTempFile(t *testing.T, contents []byte) string {
+	file, err := ioutil.TempFile("", "email_test")
+	if err != nil {
+		t.Fatalf("Error from TempFile: %s", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(contents); err != nil {
+		t.Fatalf("Error from Write: %s", err)
+	}
+	return file.Name()
+}
+
+func testRecipients(t *testing.T, to, cc, bcc string) Recipients {
+	recipients, err := parseRecipients(to, cc, bcc)
+	if err != nil {
+		t.Fatalf("Error from parseRecipients: %s", err)
+	}
+	return recipients
+}
+
+const TEST_MESSAGE = "Subject: Report\r\n\r\nHello\r\n"
+
+func TestSendMailTls(t *testing.T) {
+	certificate, certificatePem := newTestCertificate(t)
+	caFile := writeTempFile(t, certificatePem)
+	defer os.Remove(caFile)
+
+	tests := []struct {
+		name        string
+		startTls    bool
+		implicitTls bool
+		config      SmtpConfig
+		expectedTls bool
+		expectedErr string
+	}{
+		{"starttls offered", true, false, SmtpConfig{TLS: "starttls", CAFile: caFile}, true, ""},
+		{"starttls not offered", false, false, SmtpConfig{TLS: "starttls"}, false, ""},
+		{"blank means starttls", true, false, SmtpConfig{CAFile: caFile}, true, ""},
+		{"starttls with unverified certificate", true, false, SmtpConfig{TLS: "starttls"}, true, ""},
+		{"starttls-required", true, false,
+			SmtpConfig{TLS: "starttls-required", CAFile: caFile}, true, ""},
+		{"starttls-required not offered", false, false,
+			SmtpConfig{TLS: "starttls-required", CAFile: caFile}, false, "doesn't support STARTTLS"},
+		{"starttls-required with unverified certificate", true, false,
+			SmtpConfig{TLS: "starttls-required"}, false, "Error from c.StartTLS"},
+		{"starttls-required skipping verification", true, false,
+			SmtpConfig{TLS: "starttls-required", InsecureSkipVerify: true}, true, ""},
+		{"implicit", false, true, SmtpConfig{TLS: "implicit", CAFile: caFile}, true, ""},
+		{"implicit with unverified certificate", false, true,
+			SmtpConfig{TLS: "implicit"}, false, "Error connecting"},
+		{"none", true, false, SmtpConfig{TLS: "none"}, false, ""},
+	}
+	for _, test := range tests {
+		server := newFakeSmtpServer(t, certificate, test.startTls, test.implicitTls, false)
+		test.config.HostPort = server.HostPort()
+		err := sendMail(test.config, "Reports <reports@example.com>",
+			testRecipients(t, "a@example.com", "", ""), []byte(TEST_MESSAGE))
+		messages, messagesTls := server.Messages()
+		server.Close()
+
+		if test.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("%s: expected error containing %q but got %v",
+					test.name, test.expectedErr, err)
+			}
+			if len(messages) != 0 {
+				t.Errorf("%s: expected no message but got %v", test.name, messages)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error from sendMail: %s", test.name, err)
+			continue
+		}
+		if len(messages) != 1 || !strings.Contains(messages[0], "Hello") {
+			t.Errorf("%s: expected the message but got %v", test.name, messages)
+			continue
+		}
+		if messagesTls[0] != test.expectedTls {
+			t.Errorf("%s: expected TLS %v but got %v", test.name, test.expectedTls, messagesTls[0])
+		}
+	}
+}
+
+func TestSendMailAuth(t *testing.T) {
+	certificate, _ := newTestCertificate(t)
+
+	tests := []struct {
+		name             string
+		advertised       bool
+		config           SmtpConfig
+		expectedCommands []string
+		expectedErr      string
+	}{
+		{"plain", true, SmtpConfig{Auth: "plain", Username: "user", Password: "secret"},
+			[]string{"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))},
+			""},
+		{"login", true, SmtpConfig{Auth: "login", Username: "user", Password: "secret"},
+			[]string{"AUTH LOGIN",
+				base64.StdEncoding.EncodeToString([]byte("user")),
+				base64.StdEncoding.EncodeToString([]byte("secret"))},
+			""},
+		{"not advertised", false, SmtpConfig{Auth: "plain", Username: "user", Password: "secret"},
+			nil, "doesn't support AUTH"},
+		{"unknown mechanism", true, SmtpConfig{Auth: "xoauth2"}, nil, "Unknown SMTP auth"},
+	}
+	for _, test := range tests {
+		server := newFakeSmtpServer(t, certificate, true, false, test.advertised)
+		test.config.HostPort = server.HostPort()
+		test.config.InsecureSkipVerify = true
+		err := sendMail(test.config, "reports@example.com",
+			testRecipients(t, "a@example.com", "", ""), []byte(TEST_MESSAGE))
+		commands := server.Commands()
+		server.Close()
+
+		if test.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("%s: expected error containing %q but got %v",
+					test.name, test.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error from sendMail: %s", test.name, err)
+			continue
+		}
+		if !containsInOrder(commands, test.expectedCommands) {
+			t.Errorf("%s: expected commands %v in %v", test.name, test.expectedCommands, commands)
+		}
+	}
+}
+
+func containsInOrder(commands, expected []string) bool {
+	for i := 0; i+len(expected) <= len(commands); i++ {
+		found := true
+		for j := range expected {
+			if commands[i+j] != expected[j] {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSendMailRejectedRecipients(t *testing.T) {
+	certificate, _ := newTestCertificate(t)
+
+	server := newFakeSmtpServer(t, certificate, false, false, false)
+	defer server.Close()
+	err := sendMail(SmtpConfig{HostPort: server.HostPort()}, "reports@example.com",
+		testRecipients(t, "a@example.com, reject-b@example.com", "c@example.com",
+			"reject-d@example.com"),
+		[]byte(TEST_MESSAGE))
+
+	var rejectedErr *RejectedRecipientsError
+	if !errors.As(err, &rejectedErr) {
+		t.Fatalf("Expected a RejectedRecipientsError but got %v", err)
+	}
+	if rejectedErr.NumRecipients != 4 || len(rejectedErr.Rejected) != 2 ||
+		rejectedErr.Rejected[0].Address != "reject-b@example.com" ||
+		rejectedErr.Rejected[1].Address != "reject-d@example.com" {
+		t.Errorf("Unexpected rejections %+v", rejectedErr)
+	}
+	if messages, _ := server.Messages(); len(messages) != 1 {
+		t.Errorf("Expected the message to go to the other recipients but got %v", messages)
+	}
+
+	rcpts := []string{}
+	for _, command := range server.Commands() {
+		if strings.HasPrefix(command, "RCPT") {
+			rcpts = append(rcpts, command)
+		}
+	}
+	expected := []string{
+		"RCPT TO:<a@example.com>",
+		"RCPT TO:<reject-b@example.com>",
+		"RCPT TO:<c@example.com>",
+		"RCPT TO:<reject-d@example.com>",
+	}
+	if strings.Join(rcpts, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected one RCPT per recipient, including Bcc, but got %v", rcpts)
+	}
+}
+
+func TestSendMailAllRecipientsRejected(t *testing.T) {
+	certificate, _ := newTestCertificate(t)
+
+	server := newFakeSmtpServer(t, certificate, false, false, false)
+	defer server.Close()
+	err := sendMail(SmtpConfig{HostPort: server.HostPort()}, "reports@example.com",
+		Recipients{To: []*mail.Address{{Address: "reject-a@example.com"}}},
+		[]byte(TEST_MESSAGE))
+
+	var rejectedErr *RejectedRecipientsError
+	if !errors.As(err, &rejectedErr) || len(rejectedErr.Rejected) != 1 {
+		t.Fatalf("Expected a RejectedRecipientsError but got %v", err)
+	}
+	for _, command := range server.Commands() {
+		if command == "DATA" {
+			t.Errorf("Expected no DATA when every recipient is rejected")
+		}
+	}
+	if messages, _ := server.Messages(); len(messages) != 0 {
+		t.Errorf("Expected no message but got %v", messages)
+	}
+}
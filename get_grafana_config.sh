@@ -1,2 +1,18 @@
 #!/bin/bash -ex
 ssh -i ~/.ssh/vultr root@build.danstutzman.com "sqlite3 /root/grafana/data/grafana.db 'select data from dashboard;'" > grafana_config.txt
+ssh -i ~/.ssh/vultr root@build.danstutzman.com "sqlite3 /root/grafana/data/grafana.db" > grafana_datasources.txt <<EOF2
+select json_object(
+  'uid', uid,
+  'name', name,
+  'type', type,
+  'url', url,
+  'database', database,
+  'user', user,
+  'password', password,
+  'basic_auth', json(case when basic_auth then 'true' else 'false' end),
+  'basic_auth_user', basic_auth_user,
+  'basic_auth_password', basic_auth_password,
+  'is_default', json(case when is_default then 'true' else 'false' end),
+  'json_data', json(coalesce(json_data, '{}')))
+from data_source;
+EOF2
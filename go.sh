@@ -9,5 +9,7 @@ $GOPATH/bin/email-grafana-reports \
   -pngPath out.png \
   -influxdbUsername admin \
   -influxdbPassword `cat INFLUXDB_PASSWORD` \
-  -grafanaConfigPath grafana_config.txt
+  -grafanaConfigPath grafana_config.txt \
+  -dataSourcesPath grafana_datasources.txt \
+  -excludeDataSources belugacdn
 open out.png
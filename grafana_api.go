@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const GRAFANA_API_TIMEOUT = 30 * time.Second
+
+// Reads dashboards and datasources from Grafana's HTTP API, authenticating with an API key
+// or service account token
+type GrafanaClient struct {
+	baseUrl    string
+	token      string
+	httpClient *http.Client
+}
+
+type GrafanaSearchResult struct {
+	Uid         string   `json:"uid"`
+	Title       string   `json:"title"`
+	Type        string   `json:"type"`
+	Tags        []string `json:"tags"`
+	FolderUid   string   `json:"folderUid"`
+	FolderTitle string   `json:"folderTitle"`
+}
+
+// A datasource as /api/datasources lists it, which leaves out passwords
+type grafanaDataSource struct {
+	Uid           string             `json:"uid"`
+	Name          string             `json:"name"`
+	Type          string             `json:"type"`
+	Url           string             `json:"url"`
+	Database      string             `json:"database"`
+	User          string             `json:"user"`
+	BasicAuth     bool               `json:"basicAuth"`
+	BasicAuthUser string             `json:"basicAuthUser"`
+	IsDefault     bool               `json:"isDefault"`
+	JsonData      DataSourceJsonData `json:"jsonData"`
+}
+
+type grafanaDashboardResponse struct {
+	Dashboard Dashboard `json:"dashboard"`
+}
+
+func NewGrafanaClient(baseUrl, token string) *GrafanaClient {
+	return &GrafanaClient{
+		baseUrl:    strings.TrimRight(baseUrl, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: GRAFANA_API_TIMEOUT},
+	}
+}
+
+// Lists dashboards having all of tags, and in folder (matched by title or
+// uid; "General" means dashboards outside any folder) unless it's blank
+func (client *GrafanaClient) SearchDashboards(folder string,
+	tags []string) ([]GrafanaSearchResult, error) {
+
+	params := url.Values{}
+	params.Set("type", "dash-db")
+	params.Set("limit", "5000")
+	for _, tag := range tags {
+		params.Add("tag", tag)
+	}
+
+	results := []GrafanaSearchResult{}
+	if err := client.get("/api/search", params, &results); err != nil {
+		return nil, err
+	}
+
+	if folder == "" {
+		return results, nil
+	}
+	matching := []GrafanaSearchResult{}
+	for _, result := range results {
+		if result.FolderTitle == folder || result.FolderUid == folder ||
+			(folder == "General" && result.FolderUid == "") {
+			matching = append(matching, result)
+		}
+	}
+	return matching, nil
+}
+
+func (client *GrafanaClient) GetDashboard(uid string) (Dashboard, error) {
+	response := grafanaDashboardResponse{}
+	if err := client.get("/api/dashboards/uid/"+url.PathEscape(uid), nil,
+		&response); err != nil {
+		return Dashboard{}, err
+	}
+	response.Dashboard.normalize()
+	return response.Dashboard, nil
+}
+
+// Loads every dashboard SearchDashboards finds, in search order
+func (client *GrafanaClient) LoadDashboards(folder string,
+	tags []string) ([]Dashboard, error) {
+
+	results, err := client.SearchDashboards(folder, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	dashboards := []Dashboard{}
+	for _, result := range results {
+		dashboard, err := client.GetDashboard(result.Uid)
+		if err != nil {
+			return nil, err
+		}
+		dashboards = append(dashboards, dashboard)
+	}
+	return dashboards, nil
+}
+
+// Lists the organization's datasources; the token needs permission to read
+// them, and their passwords aren't included. So Prometheus datasources are
+// queried through Grafana's datasource proxy, which adds their credentials,
+// using the token.
+func (client *GrafanaClient) GetDataSources() ([]DataSource, error) {
+	results := []grafanaDataSource{}
+	if err := client.get("/api/datasources", nil, &results); err != nil {
+		return nil, err
+	}
+
+	dataSources := []DataSource{}
+	for _, result := range results {
+		dataSource := DataSource{
+			Uid:           result.Uid,
+			Name:          result.Name,
+			Type:          result.Type,
+			Url:           result.Url,
+			Database:      result.Database,
+			User:          result.User,
+			BasicAuth:     result.BasicAuth,
+			BasicAuthUser: result.BasicAuthUser,
+			IsDefault:     result.IsDefault,
+			JsonData:      result.JsonData,
+		}
+		if dataSource.Type == "prometheus" && dataSource.Uid != "" {
+			dataSource.Url = client.baseUrl + "/api/datasources/proxy/uid/" +
+				url.PathEscape(dataSource.Uid)
+			dataSource.BasicAuth = false
+			dataSource.bearerToken = client.token
+		}
+		dataSources = append(dataSources, dataSource)
+	}
+	return dataSources, nil
+}
+
+func (client *GrafanaClient) get(path string, params url.Values,
+	into interface{}) error {
+
+	requestUrl := client.baseUrl + path
+	if len(params) > 0 {
+		requestUrl += "?" + params.Encode()
+	}
+
+	request, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		return fmt.Errorf("Error from NewRequest: %s", err)
+	}
+	request.Header.Set("Accept", "application/json")
+	if client.token != "" {
+		request.Header.Set("Authorization", "Bearer "+client.token)
+	}
+
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("Error from GET %s: %s", requestUrl, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("GET %s returned %s: %s", requestUrl, response.Status,
+			strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(response.Body).Decode(into); err != nil {
+		return fmt.Errorf("Error decoding response from %s: %s", requestUrl, err)
+	}
+	return nil
+}
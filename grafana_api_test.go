@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const GRAFANA_SEARCH_JSON = `[
+  {"id": 1, "uid": "cpu", "title": "CPU", "uri": "db/cpu", "type": "dash-db",
+   "tags": ["servers"], "isStarred": false},
+  {"id": 2, "uid": "disk", "title": "Disk", "uri": "db/disk", "type": "dash-db",
+   "tags": ["servers"], "isStarred": false,
+   "folderId": 5, "folderUid": "ops", "folderTitle": "Operations"}
+]`
+
+// As Grafana 8 returns it: top-level panels, a collapsed row, and
+// datasources referred to by uid
+const GRAFANA_CPU_DASHBOARD_JSON = `{
+  "meta": {"type": "db", "slug": "cpu", "folderId": 0},
+  "dashboard": {
+    "uid": "cpu",
+    "title": "CPU",
+    "schemaVersion": 30,
+    "tags": ["servers"],
+    "time": {"from": "now-6h", "to": "now"},
+    "panels": [
+      {"id": 1, "type": "graph", "title": "Load",
+       "gridPos": {"h": 8, "w": 12, "x": 0, "y": 0},
+       "datasource": {"type": "influxdb", "uid": "P951FEA4DE68E13C5"},
+       "targets": [{"refId": "A", "query": "SELECT mean(load1) FROM system", "rawQuery": true}]},
+      {"id": 2, "type": "row", "title": "Details", "collapsed": true,
+       "gridPos": {"h": 1, "w": 24, "x": 0, "y": 8},
+       "panels": [
+         {"id": 3, "type": "graph", "title": "Steal",
+          "gridPos": {"h": 8, "w": 12, "x": 0, "y": 9},
+          "datasource": {"type": "prometheus", "uid": "prom"},
+          "targets": [{"refId": "A", "expr": "rate(node_cpu_seconds_total{mode=\"steal\"}[5m])"}]}
+       ]}
+    ]
+  }
+}`
+
+const GRAFANA_DISK_DASHBOARD_JSON = `{
+  "meta": {"type": "db", "slug": "disk", "folderId": 5},
+  "dashboard": {
+    "uid": "disk",
+    "title": "Disk",
+    "schemaVersion": 14,
+    "rows": [{"title": "Usage", "panels": [{"id": 1, "type": "graph", "title": "Free"}]}]
+  }
+}`
+
+const GRAFANA_DATASOURCES_JSON = `[
+  {"id": 1, "uid": "P951FEA4DE68E13C5", "orgId": 1, "name": "InfluxDB", "type": "influxdb",
+   "typeName": "InfluxDB", "access": "proxy", "url": "http://localhost:8086",
+   "user": "grafana", "database": "", "basicAuth": false, "isDefault": true,
+   "jsonData": {"dbName": "telegraf", "timeInterval": "10s"}, "readOnly": false},
+  {"id": 2, "uid": "prom", "orgId": 1, "name": "Prometheus", "type": "prometheus",
+   "typeName": "Prometheus", "access": "proxy", "url": "http://localhost:9090",
+   "user": "", "database": "", "basicAuth": true, "basicAuthUser": "reports",
+   "isDefault": false, "jsonData": {"httpMethod": "POST"}, "readOnly": false}
+]`
+
+func newGrafanaServer(t *testing.T, requests *[]*http.Request) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*requests = append(*requests, r)
+			if r.Header.Get("Authorization") != "Bearer glsa_token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"message":"Unauthorized"}`))
+				return
+			}
+
+			body, found := map[string]string{
+				"/api/search":              GRAFANA_SEARCH_JSON,
+				"/api/dashboards/uid/cpu":  GRAFANA_CPU_DASHBOARD_JSON,
+				"/api/dashboards/uid/disk": GRAFANA_DISK_DASHBOARD_JSON,
+				"/api/datasources":         GRAFANA_DATASOURCES_JSON,
+				"/api/datasources/proxy/uid/prom/api/v1/query_range": PROMETHEUS_MATRIX,
+			}[r.URL.Path]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"message":"Dashboard not found"}`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}))
+}
+
+func TestGrafanaLoadDashboards(t *testing.T) {
+	requests := []*http.Request{}
+	server := newGrafanaServer(t, &requests)
+	defer server.Close()
+
+	client := NewGrafanaClient(server.URL+"/", "glsa_token")
+	dashboards, err := client.LoadDashboards("", []string{"servers", "prod"})
+	if err != nil {
+		t.Fatalf("Error from LoadDashboards: %s", err)
+	}
+
+	params := requests[0].URL.Query()
+	if params.Get("type") != "dash-db" ||
+		strings.Join(params["tag"], ",") != "servers,prod" {
+		t.Errorf("Unexpected search params %s", requests[0].URL.RawQuery)
+	}
+
+	if len(dashboards) != 2 || dashboards[0].Title != "CPU" || dashboards[1].Title != "Disk" {
+		t.Fatalf("Unexpected dashboards %+v", dashboards)
+	}
+
+	cpu := dashboards[0]
+	if len(cpu.Panels) != 0 || len(cpu.Rows) != 2 {
+		t.Fatalf("Expected panels to be normalized into 2 rows but got %+v", cpu.Rows)
+	}
+	if cpu.Rows[0].Title != "" || len(cpu.Rows[0].Panels) != 1 ||
+		cpu.Rows[0].Panels[0].Title != "Load" {
+		t.Errorf("Unexpected first row %+v", cpu.Rows[0])
+	}
+	if cpu.Rows[1].Title != "Details" || len(cpu.Rows[1].Panels) != 1 ||
+		cpu.Rows[1].Panels[0].Title != "Steal" {
+		t.Errorf("Unexpected collapsed row %+v", cpu.Rows[1])
+	}
+	if cpu.Rows[0].Panels[0].DataSource != "P951FEA4DE68E13C5" {
+		t.Errorf("Expected the datasource uid but got %q", cpu.Rows[0].Panels[0].DataSource)
+	}
+
+	disk := dashboards[1]
+	if len(disk.Rows) != 1 || disk.Rows[0].Title != "Usage" {
+		t.Errorf("Expected the rows of an old schema to stay as they are but got %+v", disk.Rows)
+	}
+}
+
+func TestGrafanaSearchDashboardsInFolder(t *testing.T) {
+	requests := []*http.Request{}
+	server := newGrafanaServer(t, &requests)
+	defer server.Close()
+	client := NewGrafanaClient(server.URL, "glsa_token")
+
+	tests := []struct {
+		folder   string
+		expected string
+	}{
+		{"", "cpu,disk"},
+		{"Operations", "disk"},
+		{"ops", "disk"},
+		{"General", "cpu"},
+		{"Other", ""},
+	}
+	for _, test := range tests {
+		results, err := client.SearchDashboards(test.folder, nil)
+		if err != nil {
+			t.Fatalf("Error from SearchDashboards: %s", err)
+		}
+		uids := []string{}
+		for _, result := range results {
+			uids = append(uids, result.Uid)
+		}
+		if strings.Join(uids, ",") != test.expected {
+			t.Errorf("Folder %q: expected %s but got %v", test.folder, test.expected, uids)
+		}
+	}
+}
+
+func TestGrafanaGetDataSources(t *testing.T) {
+	requests := []*http.Request{}
+	server := newGrafanaServer(t, &requests)
+	defer server.Close()
+
+	dataSourceList, err := NewGrafanaClient(server.URL, "glsa_token").GetDataSources()
+	if err != nil {
+		t.Fatalf("Error from GetDataSources: %s", err)
+	}
+	dataSources := NewDataSources(dataSourceList, time.Second)
+
+	influxdb, err := dataSources.Lookup("P951FEA4DE68E13C5")
+	if err != nil {
+		t.Fatalf("Error from Lookup by uid: %s", err)
+	}
+	if influxdb.Name != "InfluxDB" || influxdb.Url != "http://localhost:8086" ||
+		influxdb.User != "grafana" || influxdb.Database != "telegraf" ||
+		influxdb.JsonData.TimeInterval != "10s" || influxdb.influxdbClient == nil {
+		t.Errorf("Unexpected InfluxDB datasource %+v", influxdb)
+	}
+	if dataSource, err := dataSources.Lookup("default"); err != nil || dataSource != influxdb {
+		t.Errorf("Expected InfluxDB to be the default but got %v, %v", dataSource, err)
+	}
+
+	prometheus, err := dataSources.Lookup("Prometheus")
+	if err != nil {
+		t.Fatalf("Error from Lookup by name: %s", err)
+	}
+	if prometheus.Uid != "prom" || prometheus.Type != "prometheus" ||
+		prometheus.Url != server.URL+"/api/datasources/proxy/uid/prom" || prometheus.BasicAuth {
+		t.Errorf("Unexpected Prometheus datasource %+v", prometheus)
+	}
+
+	// Grafana's proxy adds the basic auth password, which its API won't reveal
+	allSeries, err := queryPrometheus(context.Background(), prometheus, "up", "",
+		time.Unix(1600000000, 0), time.Unix(1600003600, 0), time.Minute)
+	if err != nil {
+		t.Fatalf("Error from queryPrometheus through the proxy: %s", err)
+	}
+	if len(allSeries) != 2 {
+		t.Errorf("Expected 2 series but got %+v", allSeries)
+	}
+	if _, _, ok := requests[len(requests)-1].BasicAuth(); ok {
+		t.Errorf("Expected the token instead of basic auth")
+	}
+}
+
+func TestGrafanaErrors(t *testing.T) {
+	requests := []*http.Request{}
+	server := newGrafanaServer(t, &requests)
+	defer server.Close()
+
+	_, err := NewGrafanaClient(server.URL, "glsa_token").GetDashboard("missing")
+	if err == nil || !strings.Contains(err.Error(), "404 Not Found: {\"message\":\"Dashboard not found\"}") {
+		t.Errorf("Expected a 404 error but got %v", err)
+	}
+
+	_, err = NewGrafanaClient(server.URL, "wrong").GetDataSources()
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Errorf("Expected a 401 error but got %v", err)
+	}
+}
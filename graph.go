@@ -0,0 +1,395 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strings"
+
+	chart "github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
+)
+
+// Grafana's defaults for graph options a panel doesn't set
+const DEFAULT_FILL = 1
+const DEFAULT_LINE_WIDTH = 1
+const DEFAULT_POINT_RADIUS = 5.0
+
+// Bars take up this much of the smallest gap between points
+const BAR_WIDTH_RATIO = 0.8
+
+// How a graph panel draws its series
+type GraphOptions struct {
+	fill          float64 // opacity of the area under lines, 0-1
+	lineWidth     float64
+	lines         bool
+	bars          bool
+	points        bool
+	pointRadius   float64
+	stack         bool
+	percentage    bool
+	steppedLine   bool
+	nullPointMode string
+	// Set per series by overrides
+	rightYAxis bool
+	hidden     bool
+	negativeY  bool
+}
+
+func panelGraphOptions(panel Panel) GraphOptions {
+	options := GraphOptions{
+		fill:          DEFAULT_FILL / 10.0,
+		lineWidth:     DEFAULT_LINE_WIDTH,
+		lines:         true,
+		bars:          panel.Bars,
+		points:        panel.Points,
+		pointRadius:   panel.Pointradius,
+		stack:         panel.Stack,
+		percentage:    panel.Stack && panel.Percentage,
+		steppedLine:   panel.SteppedLine,
+		nullPointMode: panel.NullPointMode,
+	}
+	if panel.Fill != nil {
+		options.fill = float64(*panel.Fill) / 10
+	}
+	if panel.Linewidth != nil {
+		options.lineWidth = float64(*panel.Linewidth)
+	}
+	if panel.Lines != nil {
+		options.lines = *panel.Lines
+	}
+	if options.pointRadius <= 0 {
+		options.pointRadius = DEFAULT_POINT_RADIUS
+	}
+	return options
+}
+
+// A series as drawn: nulls handled and values stacked, with NaN in yvalues
+// wherever the line has a gap
+type graphSeries struct {
+	name    string
+	color   drawing.Color
+	options GraphOptions
+	yAxis   chart.YAxisType // which of go-chart's axes; see drawChart
+	xvalues []float64
+	yvalues []float64
+	// Where the fill and bars start from for each point: the series below
+	// when stacked, otherwise 0
+	bases []float64
+}
+
+func (options GraphOptions) withOverride(override SeriesOverride) GraphOptions {
+	if override.Fill != nil {
+		options.fill = float64(*override.Fill) / 10
+	}
+	if override.Linewidth != nil {
+		options.lineWidth = float64(*override.Linewidth)
+	}
+	if override.Yaxis != 0 {
+		options.rightYAxis = override.Yaxis == 2
+	}
+	if override.HiddenSeries != nil {
+		options.hidden = *override.HiddenSeries
+	}
+	if override.Transform != "" {
+		options.negativeY = override.Transform == "negative-Y"
+	}
+	return options
+}
+
+// Whether an override's alias, a series name or a /regex/, matches
+func overrideMatches(override SeriesOverride, name string) bool {
+	if !strings.HasPrefix(override.Alias, "/") {
+		return override.Alias == name
+	}
+	regex, err := compileSlashedRegex(override.Alias)
+	if err != nil {
+		log.Printf("Ignoring series override: %s", err)
+		return false
+	}
+	return regex.MatchString(name)
+}
+
+// The unit of a series' values: a stat panel's own unit, or the format of
+// the y axis it's drawn on
+func seriesFormat(panel Panel, name string) string {
+	switch panel.Type {
+	case "singlestat":
+		return panel.Format
+	case "stat":
+		return panel.FieldConfig.Defaults.Unit
+	}
+
+	axis := 0
+	for _, override := range panel.SeriesOverrides {
+		if override.Yaxis != 0 && overrideMatches(override, name) {
+			axis = override.Yaxis - 1
+		}
+	}
+	if axis >= 0 && axis < len(panel.YAxes) {
+		return panel.YAxes[axis].Format
+	}
+	return ""
+}
+
+// The color Grafana would draw the index'th series in: the next in its
+// palette unless aliasColors or an override says otherwise
+func seriesColor(panel Panel, name string, index int) drawing.Color {
+	color := grafanaColor(index)
+	colors := []string{panel.AliasColors[name]}
+	for _, override := range panel.SeriesOverrides {
+		if override.Color != "" && overrideMatches(override, name) {
+			colors = append(colors, override.Color)
+		}
+	}
+	for _, colorString := range colors {
+		if colorString == "" {
+			continue
+		}
+		parsed, err := parseColor(colorString)
+		if err != nil {
+			log.Printf("Ignoring color for series '%s': %s", name, err)
+			continue
+		}
+		color = parsed
+	}
+	return color
+}
+
+// Where a point stacks: series on different y axes stack separately
+type stackKey struct {
+	rightYAxis bool
+	x          int64
+}
+
+// Applies overrides, the null point mode and stacking to the series, in
+// order, so later series stack on top of earlier ones. Leaves out hidden
+// series.
+func toGraphSeries(allSeries []Series, panel Panel) []graphSeries {
+	panelOptions := panelGraphOptions(panel)
+	graphs := []graphSeries{}
+	for i, series := range allSeries {
+		options := panelOptions
+		for _, override := range panel.SeriesOverrides {
+			if overrideMatches(override, series.Name) {
+				options = options.withOverride(override)
+			}
+		}
+		graph := graphSeries{
+			name:    series.Name,
+			color:   seriesColor(panel, series.Name, i),
+			options: options,
+		}
+		for _, point := range series.Points {
+			value := point.Value
+			if math.IsNaN(value) {
+				if options.nullPointMode == "connected" {
+					continue
+				} else if options.nullPointMode == "null as zero" {
+					value = 0
+				}
+			}
+			if options.negativeY {
+				value = -value
+			}
+			graph.xvalues = append(graph.xvalues, float64(point.Time.UnixNano()))
+			graph.yvalues = append(graph.yvalues, value)
+		}
+		if !options.hidden {
+			graphs = append(graphs, graph)
+		}
+	}
+
+	totals := map[stackKey]float64{}
+	for _, graph := range graphs {
+		for i, y := range graph.yvalues {
+			if graph.options.percentage && !math.IsNaN(y) {
+				totals[stackKey{graph.options.rightYAxis, int64(graph.xvalues[i])}] += math.Abs(y)
+			}
+		}
+	}
+
+	stacked := map[stackKey]float64{}
+	for g := range graphs {
+		graph := &graphs[g]
+		graph.bases = make([]float64, len(graph.yvalues))
+		for i, value := range graph.yvalues {
+			key := stackKey{graph.options.rightYAxis, int64(graph.xvalues[i])}
+			if graph.options.percentage && !math.IsNaN(value) {
+				if totals[key] == 0 {
+					value = 0
+				} else {
+					value = value / totals[key] * 100
+				}
+			}
+			if graph.options.stack {
+				graph.bases[i] = stacked[key]
+				if !math.IsNaN(value) {
+					value += graph.bases[i]
+					stacked[key] = value
+				}
+			}
+			graph.yvalues[i] = value
+		}
+	}
+	return graphs
+}
+
+// The y values the chart has to show, including the bases of areas and
+// bars. A log scale can only show positive values.
+func (series graphSeries) yExtent(positiveOnly bool) (min, max float64, ok bool) {
+	min = math.MaxFloat64
+	max = -math.MaxFloat64
+	for i, y := range series.yvalues {
+		values := []float64{y}
+		if series.options.bars || (series.options.lines && series.options.fill > 0) {
+			values = append(values, series.bases[i])
+		}
+		for _, value := range values {
+			if math.IsNaN(value) || (positiveOnly && value <= 0) {
+				continue
+			}
+			min = math.Min(min, value)
+			max = math.Max(max, value)
+			ok = true
+		}
+	}
+	return min, max, ok
+}
+
+func (series graphSeries) GetName() string {
+	return series.name
+}
+
+func (series graphSeries) GetYAxis() chart.YAxisType {
+	return series.yAxis
+}
+
+// Used by the legend
+func (series graphSeries) GetStyle() chart.Style {
+	return chart.Style{
+		Show:        true,
+		StrokeColor: series.color,
+		StrokeWidth: math.Max(series.options.lineWidth, 1),
+	}
+}
+
+func (series graphSeries) Render(renderer chart.Renderer, canvasBox chart.Box,
+	xrange, yrange chart.Range, defaults chart.Style) {
+
+	toX := func(x float64) int { return canvasBox.Left + xrange.Translate(x) }
+	// Clamped so areas down to 0 stay on the canvas when the y axis has a min
+	toY := func(y float64) int {
+		return chart.Math.MaxInt(canvasBox.Top,
+			chart.Math.MinInt(canvasBox.Bottom, canvasBox.Bottom-yrange.Translate(y)))
+	}
+
+	if series.options.bars {
+		series.renderBars(renderer, toX, toY)
+	}
+	for _, segment := range series.segments() {
+		tops := series.path(segment, series.yvalues)
+		if series.options.lines && series.options.fill > 0 {
+			bases := series.path(segment, series.bases)
+			renderer.SetFillColor(series.color.WithAlpha(uint8(series.options.fill * 255)))
+			renderer.SetStrokeWidth(0)
+			renderer.MoveTo(toX(tops[0][0]), toY(tops[0][1]))
+			for _, point := range tops[1:] {
+				renderer.LineTo(toX(point[0]), toY(point[1]))
+			}
+			for i := len(bases) - 1; i >= 0; i-- {
+				renderer.LineTo(toX(bases[i][0]), toY(bases[i][1]))
+			}
+			renderer.Close()
+			renderer.Fill()
+		}
+		if series.options.lines && series.options.lineWidth > 0 {
+			renderer.SetStrokeColor(series.color)
+			renderer.SetStrokeWidth(series.options.lineWidth)
+			renderer.MoveTo(toX(tops[0][0]), toY(tops[0][1]))
+			for _, point := range tops[1:] {
+				renderer.LineTo(toX(point[0]), toY(point[1]))
+			}
+			renderer.Stroke()
+		}
+	}
+	if series.options.points {
+		renderer.SetFillColor(series.color)
+		for i, y := range series.yvalues {
+			if math.IsNaN(y) {
+				continue
+			}
+			x := toX(series.xvalues[i])
+			renderer.MoveTo(x+int(series.options.pointRadius), toY(y))
+			renderer.ArcTo(x, toY(y), series.options.pointRadius, series.options.pointRadius,
+				0, 2*math.Pi)
+			renderer.Close()
+			renderer.Fill()
+		}
+	}
+}
+
+// Index ranges [start, end) of the runs of points between gaps
+func (series graphSeries) segments() [][2]int {
+	segments := [][2]int{}
+	start := -1
+	for i, y := range series.yvalues {
+		if math.IsNaN(y) {
+			if start != -1 {
+				segments = append(segments, [2]int{start, i})
+			}
+			start = -1
+		} else if start == -1 {
+			start = i
+		}
+	}
+	if start != -1 {
+		segments = append(segments, [2]int{start, len(series.yvalues)})
+	}
+	return segments
+}
+
+// The x, y points to draw through for a segment, with an extra point before
+// each one for stepped lines so the line holds its value until the next
+func (series graphSeries) path(segment [2]int, yvalues []float64) [][2]float64 {
+	path := [][2]float64{}
+	for i := segment[0]; i < segment[1]; i++ {
+		if series.options.steppedLine && i > segment[0] {
+			path = append(path, [2]float64{series.xvalues[i], yvalues[i-1]})
+		}
+		path = append(path, [2]float64{series.xvalues[i], yvalues[i]})
+	}
+	return path
+}
+
+func (series graphSeries) renderBars(renderer chart.Renderer,
+	toX func(float64) int, toY func(float64) int) {
+
+	width := math.MaxInt32
+	for i := 1; i < len(series.xvalues); i++ {
+		gap := toX(series.xvalues[i]) - toX(series.xvalues[i-1])
+		if gap > 0 && gap < width {
+			width = gap
+		}
+	}
+	if width == math.MaxInt32 {
+		width = 10
+	}
+	width = int(math.Max(1, float64(width)*BAR_WIDTH_RATIO))
+
+	renderer.SetFillColor(series.color)
+	renderer.SetStrokeWidth(0)
+	for i, y := range series.yvalues {
+		if math.IsNaN(y) {
+			continue
+		}
+		left := toX(series.xvalues[i]) - width/2
+		top := toY(y)
+		bottom := toY(series.bases[i])
+		renderer.MoveTo(left, top)
+		renderer.LineTo(left+width, top)
+		renderer.LineTo(left+width, bottom)
+		renderer.LineTo(left, bottom)
+		renderer.Close()
+		renderer.Fill()
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var FILL_PATTERN = regexp.MustCompile(`^(null|none|previous|linear|-?[0-9.]+)$`)
+
+// Builds the InfluxQL for a target, either its raw query or one built from
+// the query editor's fields. Variables are substituted into each piece
+// before it's quoted, so their values can't change the query's structure.
+func targetToCommand(target Target, vars QueryVariables) (string, error) {
+	if target.RawQuery {
+		return interpolateQuery(target.Query, vars), nil
+	}
+
+	selects := make([][]Select, len(target.Selects))
+	for i, selectGroup := range target.Selects {
+		for _, select_ := range selectGroup {
+			params := QueryParams{}
+			for _, param := range select_.Params {
+				params = append(params, interpolateQuery(param, vars))
+			}
+			selects[i] = append(selects[i], Select{Type: select_.Type, Params: params})
+		}
+	}
+	select_, err := selectsToSelect(selects)
+	if err != nil {
+		return "", err
+	}
+
+	where := interpolateQuery("$timeFilter", vars)
+	if len(target.Tags) > 0 {
+		conditions := []string{}
+		for i, tag := range target.Tags {
+			condition, err := renderTagCondition(tag, i, vars)
+			if err != nil {
+				return "", err
+			}
+			conditions = append(conditions, condition)
+		}
+		// Parentheses keep an OR among the tags from escaping the time filter
+		where = "(" + strings.Join(conditions, " ") + ") AND " + where
+	}
+
+	groupBys := []string{}
+	fill := ""
+	for _, groupBy := range target.GroupBys {
+		if groupBy.Type == "time" {
+			params := append([]string{}, groupBy.Params...)
+			if len(params) == 0 || params[0] == "auto" {
+				params = []string{"$__interval"}
+			}
+			interval := interpolateQuery(params[0], vars)
+			if _, err := parseInterval(interval); err != nil {
+				return "", fmt.Errorf("Bad GROUP BY time interval: %s", err)
+			}
+			// An optional offset, e.g. time($__interval, 5m) or -5m
+			if len(params) > 1 && params[1] != "" {
+				offset := interpolateQuery(params[1], vars)
+				if _, err := parseInterval(strings.TrimPrefix(offset, "-")); err != nil {
+					return "", fmt.Errorf("Bad GROUP BY time offset: %s", err)
+				}
+				interval += ", " + offset
+			}
+			groupBys = append(groupBys, "time("+interval+")")
+		} else if groupBy.Type == "tag" {
+			if len(groupBy.Params) != 1 {
+				return "", fmt.Errorf("Expected len(Params)=1 but was %d", len(groupBy.Params))
+			}
+			groupBys = append(groupBys,
+				quoteIdentifier(interpolateQuery(groupBy.Params[0], vars)))
+		} else if groupBy.Type == "fill" {
+			if len(groupBy.Params) != 1 {
+				return "", fmt.Errorf("Expected len(Params)=1 but was %d", len(groupBy.Params))
+			}
+			if !FILL_PATTERN.MatchString(groupBy.Params[0]) {
+				return "", fmt.Errorf("Unknown fill option '%s'", groupBy.Params[0])
+			}
+			fill = " fill(" + groupBy.Params[0] + ")"
+		} else {
+			return "", fmt.Errorf("Unknown GroupBy Type '%s'", groupBy.Type)
+		}
+	}
+
+	command := fmt.Sprintf("SELECT %s FROM %s WHERE %s", select_,
+		renderMeasurement(target, vars), where)
+	if len(groupBys) > 0 {
+		command += " GROUP BY " + strings.Join(groupBys, ", ")
+	}
+	return command + fill, nil
+}
+
+// e.g. "autogen"."cpu", or a regex like /^cpu/ as is
+func renderMeasurement(target Target, vars QueryVariables) string {
+	measurement := interpolateQuery(target.Measurement, vars)
+	if isRegexLiteral(measurement) {
+		return measurement
+	}
+
+	measurement = quoteIdentifier(measurement)
+	if target.Policy != "" && target.Policy != "default" {
+		measurement = quoteIdentifier(interpolateQuery(target.Policy, vars)) + "." + measurement
+	}
+	return measurement
+}
+
+// Renders e.g. AND "host" =~ /^web/ the way Grafana does: regex operators
+// take /.../ literals, < and > take numbers, and the rest take strings.
+// The first condition has no AND or OR in front.
+func renderTagCondition(tag Tag, index int, vars QueryVariables) (string, error) {
+	condition := ""
+	if index > 0 {
+		switch strings.ToUpper(tag.Condition) {
+		case "", "AND":
+			condition = "AND "
+		case "OR":
+			condition = "OR "
+		default:
+			return "", fmt.Errorf("Unknown tag condition '%s'", tag.Condition)
+		}
+	}
+
+	value := interpolateQuery(tag.Value, vars)
+	operator := tag.Operator
+	if operator == "" {
+		if isRegexLiteral(tag.Value) {
+			operator = "=~"
+		} else {
+			operator = "="
+		}
+	}
+
+	switch operator {
+	case "=~", "!~":
+		if isRegexLiteral(tag.Value) {
+			// Interpolate inside the slashes, so a slash in a value can't
+			// end the regex
+			inner := tag.Value[1 : len(tag.Value)-1]
+			value = "/" + interpolate(inner, vars.values,
+				func(name string, values []string, format string) string {
+					return escapeRegexSlashes(
+						formatVariableValues(values, format, vars.templates[name]))
+				}) + "/"
+		} else {
+			value = regexLiteral(value)
+		}
+	case "<", ">", "<=", ">=":
+		value = interpolateLiteral(tag.Value, vars)
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			value = quoteString(value)
+		}
+	case "=", "!=", "<>":
+		value = quoteString(interpolateLiteral(tag.Value, vars))
+	default:
+		return "", fmt.Errorf("Unknown tag operator '%s'", operator)
+	}
+
+	return condition + quoteIdentifier(tag.Key) + " " + operator + " " + value, nil
+}
+
+func quoteIdentifier(name string) string {
+	if name == "*" {
+		return name
+	}
+	escaped := strings.Replace(name, `\`, `\\`, -1)
+	return `"` + strings.Replace(escaped, `"`, `\"`, -1) + `"`
+}
+
+func quoteString(value string) string {
+	escaped := strings.Replace(value, `\`, `\\`, -1)
+	return `'` + strings.Replace(escaped, `'`, `\'`, -1) + `'`
+}
+
+// Keeps a /.../ literal as it is, or makes one with value as the pattern
+func regexLiteral(value string) string {
+	if isRegexLiteral(value) {
+		return value
+	}
+	return "/" + escapeRegexSlashes(value) + "/"
+}
+
+// True for /.../ with no unescaped slash inside, which would end it early
+func isRegexLiteral(value string) bool {
+	if len(value) < 2 || value[0] != '/' || value[len(value)-1] != '/' {
+		return false
+	}
+	inner := value[1 : len(value)-1]
+	return escapeRegexSlashes(inner) == inner
+}
+
+func escapeRegexSlashes(pattern string) string {
+	escaped := ""
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			escaped += pattern[i : i+2]
+			i++
+		} else if pattern[i] == '/' {
+			escaped += `\/`
+		} else {
+			escaped += string(pattern[i])
+		}
+	}
+	return escaped
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Matches $var, ${var}, ${var:format}, [[var]] and [[var:format]]
+var VARIABLE_PATTERN = regexp.MustCompile(
+	`\$(\w+)|\$\{(\w+)(?::(\w+))?\}|\[\[(\w+)(?::(\w+))?\]\]`)
+
+// Values to substitute into a query, with the dashboard's definitions of
+// the template variables among them, which decide how values are escaped
+type QueryVariables struct {
+	values    map[string][]string
+	templates map[string]TemplateVariable
+}
+
+// The dashboard's resolved template variables plus the ones available to
+// every query
+func queryVariables(templateVars map[string][]string, templates []TemplateVariable,
+	xMin, xMax time.Time, interval time.Duration) QueryVariables {
+
+	vars := map[string][]string{}
+	for name, values := range templateVars {
+		vars[name] = values
+	}
+	templatesByName := map[string]TemplateVariable{}
+	for _, template := range templates {
+		templatesByName[template.Name] = template
+	}
+
+	timeFilter := fmt.Sprintf("time >= %dms and time <= %dms",
+		xMin.UnixNano()/UNIX_MILLIS_TO_UNIX_NANOS,
+		xMax.UnixNano()/UNIX_MILLIS_TO_UNIX_NANOS)
+	vars["timeFilter"] = []string{timeFilter}
+	vars["__interval"] = []string{formatInterval(interval)}
+	vars["interval"] = []string{formatInterval(interval)}
+	vars["__interval_ms"] = []string{
+		fmt.Sprintf("%d", interval.Nanoseconds()/UNIX_MILLIS_TO_UNIX_NANOS)}
+
+	return QueryVariables{values: vars, templates: templatesByName}
+}
+
+// Replaces every variable reference in command, leaving references to
+// unknown variables untouched so InfluxDB can report them
+func interpolateQuery(command string, vars QueryVariables) string {
+	return interpolate(command, vars.values,
+		func(name string, values []string, format string) string {
+			return formatVariableValues(values, format, vars.templates[name])
+		})
+}
+
+// Like interpolateQuery, but a variable's one value is substituted as is,
+// for comparing literally, like host = '$host'
+func interpolateLiteral(command string, vars QueryVariables) string {
+	return interpolate(command, vars.values,
+		func(name string, values []string, format string) string {
+			if format == "" && len(values) == 1 {
+				return values[0]
+			}
+			return formatVariableValues(values, format, vars.templates[name])
+		})
+}
+
+// Like interpolateQuery, but for titles shown to people, so multiple
+// values read like "a + b" as in Grafana
+func interpolateTitle(title string, vars map[string][]string) string {
+	return interpolate(title, vars, func(name string, values []string, format string) string {
+		return strings.Join(values, " + ")
+	})
+}
+
+func interpolate(text string, vars map[string][]string,
+	formatValues func(name string, values []string, format string) string) string {
+
+	return VARIABLE_PATTERN.ReplaceAllStringFunc(text, func(match string) string {
+		groups := VARIABLE_PATTERN.FindStringSubmatch(match)
+		name := groups[1] + groups[2] + groups[4]
+		format := groups[3] + groups[5]
+
+		values, found := vars[name]
+		if !found {
+			return match
+		}
+		return formatValues(name, values, format)
+	})
+}
+
+// Formats values of the given template variable, which is zero for
+// built-in variables like $timeFilter
+func formatVariableValues(values []string, format string, variable TemplateVariable) string {
+	// Like Grafana, a custom All value such as .* is left as written
+	if variable.AllValue != "" && len(values) == 1 && values[0] == variable.AllValue {
+		return values[0]
+	}
+
+	switch format {
+	case "raw":
+		return strings.Join(values, ",")
+	case "csv":
+		return strings.Join(values, ",")
+	case "pipe":
+		return strings.Join(values, "|")
+	case "regex":
+		return regexAlternation(values)
+	}
+
+	if len(values) == 1 && !variable.Multi && !variable.IncludeAll {
+		return values[0]
+	}
+	// Grafana's default for multi-value and All variables in InfluxQL, even
+	// with one value, meant to be used like: WHERE host =~ /^$host$/
+	return regexAlternation(values)
+}
+
+func regexAlternation(values []string) string {
+	escaped := make([]string, len(values))
+	for i, value := range values {
+		escaped[i] = regexp.QuoteMeta(value)
+	}
+	if len(escaped) == 1 {
+		return escaped[0]
+	}
+	return "(" + strings.Join(escaped, "|") + ")"
+}
+
+// Formats a duration the way InfluxQL expects it, e.g. 1h or 500ms
+func formatInterval(interval time.Duration) string {
+	units := []struct {
+		suffix   string
+		duration time.Duration
+	}{
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+		{"ms", time.Millisecond},
+	}
+	for _, unit := range units {
+		if interval >= unit.duration && interval%unit.duration == 0 {
+			return fmt.Sprintf("%d%s", interval/unit.duration, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dms", interval/time.Millisecond)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInterpolateQuery(t *testing.T) {
+	templates := []TemplateVariable{
+		{Name: "plain"},
+		{Name: "multi", Multi: true},
+		{Name: "all", IncludeAll: true},
+		{Name: "custom_all", IncludeAll: true, AllValue: ".*"},
+	}
+	tests := []struct {
+		name     string
+		command  string
+		values   []string
+		expected string
+	}{
+		{"plain", "/^$plain$/", []string{"web.1"}, "/^web.1$/"},
+		{"multi", "/^$multi$/", []string{"web.1"}, `/^web\.1$/`},
+		{"multi", "/^$multi$/", []string{"web.1", "a+b"}, `/^(web\.1|a\+b)$/`},
+		{"all", "/^${all}$/", []string{"a+b"}, `/^a\+b$/`},
+		{"custom_all", "/^[[custom_all]]$/", []string{".*"}, "/^.*$/"},
+		{"custom_all", "/^$custom_all$/", []string{"web.1"}, `/^web\.1$/`},
+		{"multi", "${multi:csv}", []string{"a.b", "c"}, "a.b,c"},
+		{"multi", "${multi:pipe}", []string{"a.b", "c"}, "a.b|c"},
+		{"plain", "${plain:regex}", []string{"a.b"}, `a\.b`},
+		{"multi", "$missing stays", []string{"x"}, "$missing stays"},
+	}
+	for _, test := range tests {
+		vars := queryVariables(map[string][]string{test.name: test.values}, templates,
+			time.Unix(0, 0), time.Unix(60, 0), time.Minute)
+		actual := interpolateQuery(test.command, vars)
+		if actual != test.expected {
+			t.Errorf("%s = %v in %q: got %q, expected %q",
+				test.name, test.values, test.command, actual, test.expected)
+		}
+	}
+}
+
+func TestInterpolateBuiltIns(t *testing.T) {
+	vars := queryVariables(nil, nil, time.Unix(1600000000, 0), time.Unix(1600003600, 0),
+		10*time.Second)
+	actual := interpolateQuery(
+		"WHERE $timeFilter GROUP BY time($__interval) LIMIT $__interval_ms", vars)
+	expected := "WHERE time >= 1600000000000ms and time <= 1600003600000ms" +
+		" GROUP BY time(10s) LIMIT 10000"
+	if actual != expected {
+		t.Errorf("Got %q, expected %q", actual, expected)
+	}
+}
+
+func TestInterpolateTagConditions(t *testing.T) {
+	templates := []TemplateVariable{{Name: "host", Multi: true, IncludeAll: true}}
+	vars := queryVariables(map[string][]string{"host": {"web.1"}}, templates,
+		time.Unix(1600000000, 0), time.Unix(1600086400, 0), time.Minute)
+	tests := []struct {
+		operator string
+		value    string
+		expected string
+	}{
+		{"=~", "/^$host$/", `"host" =~ /^web\.1$/`},
+		{"!~", "/^$host$/", `"host" !~ /^web\.1$/`},
+		{"=", "$host", `"host" = 'web.1'`},
+		{"!=", "$host", `"host" != 'web.1'`},
+	}
+	for _, test := range tests {
+		tag := Tag{Key: "host", Operator: test.operator, Value: test.value}
+		actual, err := renderTagCondition(tag, 0, vars)
+		if err != nil {
+			t.Errorf("%s %s: error from renderTagCondition: %s", test.operator, test.value, err)
+		} else if actual != test.expected {
+			t.Errorf("%s %s: got %s, expected %s", test.operator, test.value, actual, test.expected)
+		}
+	}
+}
+
+func TestInterpolateTitle(t *testing.T) {
+	vars := map[string][]string{"host": {"web.1", "web.2"}}
+	actual := interpolateTitle("Load on $host ($unknown)", vars)
+	if actual != "Load on web.1 + web.2 ($unknown)" {
+		t.Errorf("Got %q", actual)
+	}
+}
+
+func TestFormatInterval(t *testing.T) {
+	tests := map[time.Duration]string{
+		2 * 7 * 24 * time.Hour:  "2w",
+		36 * time.Hour:          "36h",
+		90 * time.Second:        "90s",
+		5 * time.Minute:         "5m",
+		1500 * time.Millisecond: "1500ms",
+	}
+	for interval, expected := range tests {
+		if actual := formatInterval(interval); actual != expected {
+			t.Errorf("formatInterval(%s) = %s, expected %s", interval, actual, expected)
+		}
+	}
+}
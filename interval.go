@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var INTERVAL_PATTERN = regexp.MustCompile(`^(\d+(?:\.\d+)?)(ms|s|m|h|d|w|y)$`)
+
+// Upper bounds (exclusive) of raw intervals and what they round to,
+// copied from Grafana's kbn.roundInterval
+var ROUNDED_INTERVALS = []struct {
+	below   time.Duration
+	rounded time.Duration
+}{
+	{15 * time.Millisecond, 10 * time.Millisecond},
+	{35 * time.Millisecond, 20 * time.Millisecond},
+	{75 * time.Millisecond, 50 * time.Millisecond},
+	{150 * time.Millisecond, 100 * time.Millisecond},
+	{350 * time.Millisecond, 200 * time.Millisecond},
+	{750 * time.Millisecond, 500 * time.Millisecond},
+	{1500 * time.Millisecond, 1 * time.Second},
+	{3500 * time.Millisecond, 2 * time.Second},
+	{7500 * time.Millisecond, 5 * time.Second},
+	{12500 * time.Millisecond, 10 * time.Second},
+	{17500 * time.Millisecond, 15 * time.Second},
+	{25 * time.Second, 20 * time.Second},
+	{45 * time.Second, 30 * time.Second},
+	{90 * time.Second, 1 * time.Minute},
+	{210 * time.Second, 2 * time.Minute},
+	{450 * time.Second, 5 * time.Minute},
+	{750 * time.Second, 10 * time.Minute},
+	{1050 * time.Second, 15 * time.Minute},
+	{1500 * time.Second, 20 * time.Minute},
+	{45 * time.Minute, 30 * time.Minute},
+	{90 * time.Minute, 1 * time.Hour},
+	{150 * time.Minute, 2 * time.Hour},
+	{270 * time.Minute, 3 * time.Hour},
+	{9 * time.Hour, 6 * time.Hour},
+	{24 * time.Hour, 12 * time.Hour},
+	{7 * 24 * time.Hour, 24 * time.Hour},
+	{21 * 24 * time.Hour, 7 * 24 * time.Hour},
+	{6 * 7 * 24 * time.Hour, 30 * 24 * time.Hour},
+}
+
+// Picks a group-by interval so the time range fits in about resolution
+// buckets, like Grafana's $__interval.  lowLimit is the panel's minimum
+// interval setting, e.g. ">10s" or "1m", and may be blank.
+func calculateInterval(timeRange TimeRange, resolution int,
+	lowLimit string) (time.Duration, error) {
+
+	interval := roundInterval(timeRange.To.Sub(timeRange.From) / time.Duration(resolution))
+
+	if lowLimit != "" {
+		if lowLimit[0] == '>' {
+			lowLimit = lowLimit[1:]
+		}
+		minInterval, err := parseInterval(lowLimit)
+		if err != nil {
+			return 0, err
+		}
+		if interval < minInterval {
+			interval = minInterval
+		}
+	}
+
+	return interval, nil
+}
+
+func roundInterval(interval time.Duration) time.Duration {
+	for _, step := range ROUNDED_INTERVALS {
+		if interval < step.below {
+			return step.rounded
+		}
+	}
+	return 365 * 24 * time.Hour
+}
+
+// Parses Grafana interval strings such as 500ms, 10s, 1.5h or 1w
+func parseInterval(s string) (time.Duration, error) {
+	match := INTERVAL_PATTERN.FindStringSubmatch(s)
+	if match == nil {
+		return 0, fmt.Errorf("Invalid interval '%s'", s)
+	}
+	amount, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid interval '%s': %s", s, err)
+	}
+
+	unit := map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"y":  365 * 24 * time.Hour,
+	}[match[2]]
+	return time.Duration(amount * float64(unit)), nil
+}
@@ -1,238 +1,518 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/mail"
 	"os"
+	"os/signal"
+	"regexp"
 	"strings"
 	"time"
-
-	clientPkg "github.com/influxdata/influxdb/client/v2"
 )
 
 const UNIX_MILLIS_TO_UNIX_NANOS = 1000 * 1000
 const NUM_CHART_QUERIES_AT_ONCE = 3
-const PROMETHEUS_TIMEOUT_MILLIS = 1000
 
 type Config struct {
-	pngPath           string
 	influxdbHostname  string
 	influxdbPort      string
 	influxdbUsername  string
 	influxdbPassword  string
-	emailFrom         string
-	emailTo           string
-	emailSubject      string
-	smtpHostPort      string
-	doSendEmail       bool
+	influxdbDatabase  string
+	smtp              SmtpConfig
+	smtpPasswordFile  string
 	grafanaConfigPath string
+	grafanaUrl        string
+	grafanaTokenFile  string
+	grafanaToken      string
+	grafanaFolder     string
+	grafanaTags       string
+	dataSourcesPath   string
+	reportsConfigPath string
+	reports           []ReportConfig
+	serve             bool
+	stateFile         string
+	catchUpWindow     time.Duration
+	concurrency       int
+	queryTimeout      time.Duration
+	failOnPanelErrors bool
+	tableMaxRows      int
 }
 
 type Point struct {
 	Time  time.Time
-	Value float64
+	Value float64 // NaN for a null
+}
+
+// Flags that describe a single report, which conflict with -reportsConfigPath
+var REPORT_FLAG_NAMES = []string{
+	"pngPath", "emailTo", "emailCc", "emailBcc", "emailSubject",
+	"dashboards", "excludeDashboards", "dashboardTags", "panels",
+	"excludePanels", "excludeDataSources", "from", "to", "useDashboardTime",
+	"var",
+}
+
+// Collects repeated -var name=value1,value2 flags
+type VariablesFlag map[string][]string
+
+func (variables VariablesFlag) String() string {
+	pairs := []string{}
+	for name, values := range variables {
+		pairs = append(pairs, name+"="+strings.Join(values, ","))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (variables VariablesFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Expected name=value but got '%s'", value)
+	}
+	variables[parts[0]] = splitList(parts[1])
+	return nil
 }
 
 func getConfigFromFlags() Config {
 	config := Config{}
-	flag.StringVar(&config.pngPath, "pngPath", "", "Path to save .png image to")
+	pngPath := flag.String("pngPath", "", "Path to save .png image to")
 	flag.StringVar(&config.influxdbHostname, "influxdbHostname", "localhost", "Hostname for InfluxDB")
 	flag.StringVar(&config.influxdbPort, "influxdbPort", "8086", "Port for InfluxDB")
 	flag.StringVar(&config.influxdbUsername, "influxdbUsername", "admin", "Username for InfluxDB, e.g. admin")
-	flag.StringVar(&config.influxdbPassword, "influxdbPassword", "", "Password for InfluxDB")
-	flag.StringVar(&config.emailFrom, "emailFrom", "", "Email address to send report from; e.g. Reports <reports@monitoring.danstutzman.com>")
-	flag.StringVar(&config.emailTo, "emailTo", "", "Email address to send report to")
-	flag.StringVar(&config.emailSubject, "emailSubject", "", "Subject for email report")
-	flag.StringVar(&config.smtpHostPort, "smtpHostPort", "",
+	flag.StringVar(&config.influxdbPassword, "influxdbPassword", "", "Password for InfluxDB, including InfluxDB datasources loaded from -grafanaUrl, since Grafana doesn't reveal theirs")
+	flag.StringVar(&config.influxdbDatabase, "influxdbDatabase", "mydb", "Database for InfluxDB when -dataSourcesPath isn't given")
+	emailFrom := flag.String("emailFrom", "", "Email address to send report from; e.g. Reports <reports@monitoring.danstutzman.com>")
+	emailTo := flag.String("emailTo", "", "Comma-separated email addresses to send report to")
+	emailCc := flag.String("emailCc", "", "Comma-separated email addresses to copy report to")
+	emailBcc := flag.String("emailBcc", "", "Comma-separated email addresses to blind copy report to")
+	emailSubject := flag.String("emailSubject", "",
+		"Subject for email report; may use {{.Name}}, {{.From}}, {{.To}} and {{.NumFailures}}")
+	flag.StringVar(&config.smtp.HostPort, "smtpHostPort", "",
 		"Hostname and port for SMTP server; e.g. localhost:25")
+	flag.StringVar(&config.smtp.Auth, "smtpAuth", "",
+		"SMTP authentication: plain, login, cram-md5 or blank for none")
+	flag.StringVar(&config.smtp.Username, "smtpUsername", "", "Username for -smtpAuth")
+	flag.StringVar(&config.smtpPasswordFile, "smtpPasswordFile", "",
+		"File containing the password for -smtpAuth; if blank, $SMTP_PASSWORD is used")
+	flag.StringVar(&config.smtp.TLS, "smtpTLS", "",
+		"starttls (if offered), starttls-required, implicit or none; blank means implicit for port 465, otherwise starttls")
+	flag.StringVar(&config.smtp.CAFile, "smtpCAFile", "",
+		"PEM file of CA certificates to trust for SMTP, e.g. for an internal relay")
+	flag.BoolVar(&config.smtp.InsecureSkipVerify, "smtpInsecureSkipVerify", false,
+		"Don't verify the SMTP server's TLS certificate")
 	flag.StringVar(&config.grafanaConfigPath, "grafanaConfigPath", "",
 		"Location of file produced by get_grafana_config.sh")
+	flag.StringVar(&config.grafanaUrl, "grafanaUrl", "",
+		"Base URL of Grafana to load dashboards from instead of -grafanaConfigPath; e.g. https://grafana.example.com")
+	flag.StringVar(&config.grafanaTokenFile, "grafanaTokenFile", "",
+		"File containing a Grafana API key or service account token; if blank, $GRAFANA_TOKEN is used")
+	flag.StringVar(&config.grafanaFolder, "grafanaFolder", "",
+		"Only load dashboards in this Grafana folder (title or uid)")
+	flag.StringVar(&config.grafanaTags, "grafanaTags", "",
+		"Only load dashboards with all of these comma-separated Grafana tags")
+	dashboards := flag.String("dashboards", "",
+		"Comma-separated titles or uids of dashboards to report on; blank means all")
+	excludeDashboards := flag.String("excludeDashboards", "",
+		"Comma-separated titles or uids of dashboards to leave out")
+	dashboardTags := flag.String("dashboardTags", "",
+		"Only report on dashboards with at least one of these comma-separated tags")
+	panels := flag.String("panels", "",
+		"Only report on panels whose titles match this regular expression")
+	excludePanels := flag.String("excludePanels", "",
+		"Leave out panels whose titles match this regular expression")
+	excludeDataSources := flag.String("excludeDataSources", "",
+		"Comma-separated names of datasources whose panels should be left out")
+	flag.StringVar(&config.dataSourcesPath, "dataSourcesPath", "",
+		"Location of datasources file produced by get_grafana_config.sh; if blank, datasources come from -grafanaUrl, or else -influxdb* flags define the default datasource")
+	from := flag.String("from", "now-1d",
+		"Start of report time range; e.g. now-7d, now-1d/d, now/M or 2017-01-31")
+	to := flag.String("to", "now",
+		"End of report time range; e.g. now, now-1d/d or 2017-02-28 23:59:59")
+	useDashboardTime := flag.Bool("useDashboardTime", false,
+		"Use each dashboard's saved time range instead of -from and -to")
+	variables := VariablesFlag{}
+	flag.Var(variables, "var",
+		"Set a template variable, overriding dashboards' selections; e.g. -var host=web1,web2 or -var 'host=$__all'; can be repeated")
+	flag.StringVar(&config.reportsConfigPath, "reportsConfigPath", "",
+		"JSON file describing named reports, instead of the flags for a single report")
+	reportName := flag.String("report", "",
+		"Name of the report in -reportsConfigPath to run; blank or all runs every report")
+	flag.BoolVar(&config.serve, "serve", false,
+		"Keep running, and run each report in -reportsConfigPath on its schedule")
+	flag.StringVar(&config.stateFile, "stateFile", "",
+		"File where -serve records when each report last ran, to catch up after a restart")
+	flag.DurationVar(&config.catchUpWindow, "catchUpWindow", time.Hour,
+		"With -serve, how late a missed run can be and still run; e.g. 6h")
+	flag.IntVar(&config.concurrency, "concurrency", NUM_CHART_QUERIES_AT_ONCE,
+		"Number of panels to query and draw at once")
+	flag.DurationVar(&config.queryTimeout, "queryTimeout", 30*time.Second,
+		"How long to wait for each query before giving up on its panel")
+	flag.BoolVar(&config.failOnPanelErrors, "failOnPanelErrors", false,
+		"Exit with non-zero status if any panel failed, after sending the report")
+	flag.IntVar(&config.tableMaxRows, "tableMaxRows", DEFAULT_TABLE_MAX_ROWS,
+		"Rows to show in each table panel before cutting it short; reports can override it")
 	flag.Parse()
 
-	if config.pngPath == "" {
+	if config.grafanaConfigPath == "" && config.grafanaUrl == "" {
+		log.Fatalf("You must specify -grafanaConfigPath or -grafanaUrl")
+	} else if config.grafanaConfigPath != "" && config.grafanaUrl != "" {
+		log.Fatalf("Please specify only one of -grafanaConfigPath and -grafanaUrl")
+	}
+	if config.grafanaUrl != "" {
+		token, err := readSecret(config.grafanaTokenFile, "GRAFANA_TOKEN")
+		if err != nil {
+			log.Fatalf("Error reading Grafana token: %s", err)
+		}
+		config.grafanaToken = token
+	}
+
+	switch config.smtp.TLS {
+	case "", "starttls", "starttls-required", "implicit", "none":
+	default:
+		log.Fatalf("Unknown -smtpTLS '%s'", config.smtp.TLS)
+	}
+	switch config.smtp.Auth {
+	case "":
+	case "plain", "login", "cram-md5":
+		password, err := readSecret(config.smtpPasswordFile, "SMTP_PASSWORD")
+		if err != nil {
+			log.Fatalf("Error reading SMTP password: %s", err)
+		}
+		if config.smtp.Username == "" || password == "" {
+			log.Fatalf("-smtpAuth needs -smtpUsername and a password from -smtpPasswordFile or $SMTP_PASSWORD")
+		}
+		config.smtp.Password = password
+	default:
+		log.Fatalf("Unknown -smtpAuth '%s'", config.smtp.Auth)
+	}
+
+	if config.concurrency < 1 {
+		log.Fatalf("-concurrency must be at least 1")
+	}
+	if config.tableMaxRows < 1 {
+		log.Fatalf("-tableMaxRows must be at least 1")
+	}
+
+	if config.reportsConfigPath != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if containsString(REPORT_FLAG_NAMES, f.Name) {
+				log.Fatalf("-%s can't be used with -reportsConfigPath; set it in the file instead", f.Name)
+			}
+		})
+
+		reportsReader, err := os.Open(config.reportsConfigPath)
+		if err != nil {
+			log.Fatalf("Error from Open: %s", err)
+		}
+		defer reportsReader.Close()
+		reports, err := parseReportsConfig(reportsReader, *emailFrom, config.smtp.HostPort != "")
+		if err != nil {
+			log.Fatalf("Errors in %s:\n%s", config.reportsConfigPath, err)
+		}
+		config.reports, err = findReports(reports, *reportName)
+		if err != nil {
+			log.Fatalf("Bad -report: %s", err)
+		}
+
+		if config.serve {
+			numScheduled := 0
+			for _, report := range config.reports {
+				if report.schedule != nil {
+					numScheduled += 1
+				}
+			}
+			if numScheduled == 0 {
+				log.Fatalf("-serve needs at least one report with a schedule")
+			}
+		}
+		return config
+	} else if *reportName != "" {
+		log.Fatalf("-report needs -reportsConfigPath")
+	} else if config.serve {
+		log.Fatalf("-serve needs -reportsConfigPath")
+	}
+
+	report := ReportConfig{
+		pngPath:          *pngPath,
+		from:             *from,
+		to:               *to,
+		useDashboardTime: *useDashboardTime,
+		emailFrom:        *emailFrom,
+		variables:        variables,
+	}
+
+	if report.pngPath == "" {
 		log.Fatalf("You must specify -pngPath; try ./out.png")
 	}
-	if config.grafanaConfigPath == "" {
-		log.Fatalf("You must specify -grafanaConfigPath")
-	}
-	if config.emailFrom == "" &&
-		config.emailTo == "" &&
-		config.emailSubject == "" &&
-		config.smtpHostPort == "" {
-		config.doSendEmail = false
-	} else if config.emailFrom != "" &&
-		config.emailTo != "" &&
-		config.emailSubject != "" &&
-		config.smtpHostPort != "" {
-		config.doSendEmail = true
+	if *emailFrom == "" &&
+		*emailTo == "" &&
+		*emailCc == "" &&
+		*emailBcc == "" &&
+		*emailSubject == "" &&
+		config.smtp.HostPort == "" {
+		report.doSendEmail = false
+	} else if *emailFrom != "" &&
+		(*emailTo != "" || *emailCc != "" || *emailBcc != "") &&
+		*emailSubject != "" &&
+		config.smtp.HostPort != "" {
+		report.doSendEmail = true
 	} else {
-		log.Fatalf("Please supply values for all of -emailFrom, -emailTo, -emailSubject, and -smtpHostPort or none of them")
+		log.Fatalf("Please supply values for all of -emailFrom, -emailTo (or -emailCc or -emailBcc), -emailSubject, and -smtpHostPort or none of them")
+	}
+
+	if report.doSendEmail {
+		if _, err := mail.ParseAddress(*emailFrom); err != nil {
+			log.Fatalf("Bad -emailFrom '%s': %s", *emailFrom, err)
+		}
+		recipients, err := parseRecipients(*emailTo, *emailCc, *emailBcc)
+		if err != nil {
+			log.Fatalf("Bad recipients: %s", err)
+		}
+		report.recipients = recipients
+	}
+	subject, err := parseSubjectTemplate(*emailSubject)
+	if err != nil {
+		log.Fatalf("Bad -emailSubject: %s", err)
 	}
+	report.emailSubject = subject
 
+	report.selection = Selection{
+		Dashboards:         splitList(*dashboards),
+		ExcludeDashboards:  splitList(*excludeDashboards),
+		DashboardTags:      splitList(*dashboardTags),
+		ExcludeDataSources: splitList(*excludeDataSources),
+	}
+	if *panels != "" {
+		pattern, err := regexp.Compile(*panels)
+		if err != nil {
+			log.Fatalf("Bad -panels: %s", err)
+		}
+		report.selection.Panels = pattern
+	}
+	if *excludePanels != "" {
+		pattern, err := regexp.Compile(*excludePanels)
+		if err != nil {
+			log.Fatalf("Bad -excludePanels: %s", err)
+		}
+		report.selection.ExcludePanels = pattern
+	}
+
+	if _, err := parseTimeRange(report.from, report.to, time.Now()); err != nil {
+		log.Fatalf("Bad -from or -to: %s", err)
+	}
+
+	config.reports = []ReportConfig{report}
 	return config
 }
 
 func main() {
 	config := getConfigFromFlags()
 
-	client, err := clientPkg.NewHTTPClient(clientPkg.HTTPConfig{
-		Addr:     "http://" + config.influxdbHostname + ":" + config.influxdbPort,
-		Username: config.influxdbUsername,
-		Password: config.influxdbPassword,
-	})
-	if err != nil {
-		log.Fatalf("Error from NewHTTPClient: %s", err)
+	dataSources := loadDataSources(config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		log.Printf("Interrupted; cancelling queries")
+		cancel()
+	}()
+
+	if config.serve {
+		serve(ctx, config, dataSources)
+		return
 	}
 
-	dashboardsReader, err := os.Open(config.grafanaConfigPath)
+	dashboards, err := loadDashboards(config)
 	if err != nil {
-		log.Fatalf("Error from Open: %s", err)
+		log.Fatalf("Error loading dashboards: %s", err)
 	}
-	dashboards := parseDashboardsJson(dashboardsReader)
 
-	multichart := NewMultiChart()
-	for _, dashboard := range dashboards {
-		multichart.WriteHeader(dashboard.Title)
-		for _, row := range dashboard.Rows {
-			for _, panel := range row.Panels {
-				if panel.DataSource == "belugacdn" {
-					continue
-				}
+	numFailedReports := 0
+	numFailedPanels := 0
+	for _, report := range config.reports {
+		numFailures, err := runReport(ctx, config, report, dashboards, dataSources, time.Now())
+		if err != nil {
+			log.Printf("Error in report '%s': %s", report.name, err)
+			numFailedReports += 1
+		}
+		numFailedPanels += numFailures
+	}
 
-				dbName, dataSourceFound := map[string]string{
-					"":                   "mydb",
-					"belugacdn_logs":     "mydb",
-					"InfluxDB: cadvisor": "cadvisor",
-				}[panel.DataSource]
-				if !dataSourceFound {
-					log.Fatalf("Panel has unknown datasource: %+v", panel)
-				}
+	if numFailedReports > 0 {
+		log.Fatalf("%d report(s) failed", numFailedReports)
+	}
+	if numFailedPanels > 0 && config.failOnPanelErrors {
+		log.Fatalf("%d panel(s) failed", numFailedPanels)
+	}
+}
+
+// Renders one report, saves its PNG and emails it. Returns how many of its
+// panels failed, and an error if the report couldn't be saved or sent.
+func runReport(ctx context.Context, config Config, report ReportConfig,
+	allDashboards []Dashboard, dataSources *DataSources, now time.Time) (int, error) {
+
+	if report.name != "" {
+		log.Printf("Running report '%s'", report.name)
+	}
 
-				for _, target := range panel.Targets {
-					if target.DsType != "influxdb" {
-						log.Fatalf("Expected dsType=influxdb in panel %+v", panel)
-					}
-
-					xMin := time.Now().AddDate(0, 0, -1).UTC()
-					xMax := time.Now().UTC()
-					yMin := ""
-					if len(panel.YAxes) > 0 {
-						yMin = panel.YAxes[0].Min
-					}
-					yMax := ""
-					if len(panel.YAxes) > 0 {
-						yMax = panel.YAxes[0].Max
-					}
-
-					var command string
-					if false && target.Query != "" {
-						command = target.Query
-					} else {
-						select_ := selectsToSelect(target.Selects)
-
-						wheres := []string{"WHERE $timeFilter"}
-						for _, tag := range target.Tags {
-							where := fmt.Sprintf("%s %s '%s'", tag.Key, tag.Operator, tag.Value)
-							wheres = append(wheres, where)
-						}
-
-						groupBys := []string{}
-						fill := ""
-						for _, groupBy := range target.GroupBys {
-							if groupBy.Type == "time" {
-								groupBys = append(groupBys, "time($__interval)")
-							} else if groupBy.Type == "tag" {
-								if len(groupBy.Params) != 1 {
-									log.Fatalf("Expected len(Params)=1 but was %d", len(groupBy.Params))
-								}
-								groupBys = append(groupBys, groupBy.Params[0])
-							} else if groupBy.Type == "fill" {
-								if len(groupBy.Params) != 1 {
-									log.Fatalf("Expected len(Params)=1 but was %d", len(groupBy.Params))
-								}
-								fill = fmt.Sprintf("fill(%s)", groupBy.Params[0])
-							} else {
-								log.Fatalf("Unknown GroupBy Type '%s'", groupBy.Type)
-							}
-						}
-
-						command = fmt.Sprintf(
-							"SELECT %s FROM %s %s GROUP BY %s %s",
-							select_,
-							target.Measurement,
-							strings.Join(wheres, " AND "),
-							strings.Join(groupBys, ", "),
-							fill)
-					}
-					command = strings.Replace(command, "$timeFilter",
-						fmt.Sprintf("time > %d", xMin.UnixNano()), 1)
-					command = strings.Replace(command, "$__interval", "1h", 1)
-					if command == "" {
-						log.Fatalf("Blank query for panel %+v", panel)
-					}
-					points := query(client, dbName, command)
-
-					if len(points) > 0 {
-						image := drawChart(points, panel.Title, xMin, xMax, yMin, yMax)
-						multichart.CopyChart(image)
-					} else {
-						multichart.WriteHeader("no points")
-					}
+	dashboards := selectDashboards(report.selection, allDashboards)
+
+	reports := renderReport(ctx, config, report, dashboards, dataSources, now)
+
+	failures := summarizeFailures(reports)
+
+	if report.pngPath != "" {
+		multichart := NewMultiChart()
+		for _, report := range reports {
+			multichart.WriteHeader(report.Title)
+			for _, panel := range report.Panels {
+				if panel.Image != nil {
+					multichart.CopyChart(panel.Image)
+				} else if panel.Err != nil {
+					multichart.WriteHeader("Error: " + panel.Err.Error())
+				} else {
+					multichart.WriteHeader(panel.Message)
 				}
 			}
 		}
+		if len(failures) > 0 {
+			multichart.WriteHeader(fmt.Sprintf("%d panel(s) failed", len(failures)))
+		}
+
+		log.Printf("Writing %s", report.pngPath)
+		multichart.SaveToPng(report.pngPath)
 	}
 
-	log.Printf("Writing %s", config.pngPath)
-	multichart.SaveToPng(config.pngPath)
+	for _, failure := range failures {
+		log.Printf("Failed: %s", failure)
+	}
 
-	if config.doSendEmail {
-		sendMail(config.smtpHostPort, config.emailFrom,
-			config.emailTo, config.emailSubject, "(see attached image)",
-			config.pngPath)
+	if report.doSendEmail {
+		timeRange, err := parseTimeRange(report.from, report.to, now)
+		if err != nil {
+			return len(failures), err
+		}
+		subject, err := report.subject(timeRange, len(failures))
+		if err != nil {
+			return len(failures), err
+		}
+		message, err := composeReportEmail(report.emailFrom, report.recipients,
+			subject, reports, failures)
+		if err != nil {
+			return len(failures), fmt.Errorf("Error from composeReportEmail: %s", err)
+		}
+		err = sendMail(config.smtp, report.emailFrom, report.recipients, message)
+		var rejectedErr *RejectedRecipientsError
+		if errors.As(err, &rejectedErr) &&
+			len(rejectedErr.Rejected) < rejectedErr.NumRecipients {
+			log.Printf("Warning: %s", err)
+		} else if err != nil {
+			return len(failures), fmt.Errorf("Error from sendMail: %s", err)
+		}
 	}
+
+	return len(failures), nil
 }
 
-func selectsToSelect(selects [][]Select) string {
-	if len(selects) != 1 {
-		log.Fatalf("Expected len(selects) to be 1 but got %+v", selects)
+// Reads a secret from path if given, otherwise from the environment
+// variable envName, so it doesn't appear in the process list
+func readSecret(path, envName string) (string, error) {
+	if path == "" {
+		return os.Getenv(envName), nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
 	}
-	select1 := selects[0]
+	return strings.TrimSpace(string(contents)), nil
+}
 
-	out := ""
-	for _, select_ := range select1 {
+func loadDashboards(config Config) ([]Dashboard, error) {
+	if config.grafanaUrl != "" {
+		client := NewGrafanaClient(config.grafanaUrl, config.grafanaToken)
+		dashboards, err := client.LoadDashboards(config.grafanaFolder,
+			splitList(config.grafanaTags))
+		if err != nil {
+			return nil, fmt.Errorf("Error loading dashboards from Grafana: %s", err)
+		}
+		return dashboards, nil
+	}
 
-		if select_.Type == "field" {
-			if out == "" {
-				if len(select_.Params) != 1 {
-					log.Fatalf("Expected len(Params)=1 but was %d for selects=%+v",
-						len(select_.Params), select_)
-				}
-				out = select_.Params[0]
-			} else {
-				log.Fatalf("Select with type=field must be first; selects is %+v", select1)
-			}
-		} else if select_.Type == "count" {
-			out = "count(" + out + ")"
-		} else if select_.Type == "mean" {
-			out = "mean(" + out + ")"
-		} else if select_.Type == "derivative" {
-			if len(select_.Params) != 1 {
-				log.Fatalf("Expected len(Params)=1 but was %d for selects=%+v",
-					len(select_.Params), select_)
-			}
-			out = "derivative(" + out + ", " + select_.Params[0] + ")"
-		} else if select_.Type == "math" {
-			if len(select_.Params) != 1 {
-				log.Fatalf("Expected len(Params)=1 but was %d for selects=%+v",
-					len(select_.Params), select_)
+	dashboardsReader, err := os.Open(config.grafanaConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error from Open: %s", err)
+	}
+	defer dashboardsReader.Close()
+	return parseDashboardsJson(dashboardsReader), nil
+}
+
+func loadDataSources(config Config) *DataSources {
+	if config.dataSourcesPath == "" && config.grafanaUrl != "" {
+		client := NewGrafanaClient(config.grafanaUrl, config.grafanaToken)
+		dataSourceList, err := client.GetDataSources()
+		if err != nil {
+			log.Fatalf("Error loading datasources from Grafana: %s", err)
+		}
+		for i := range dataSourceList {
+			if dataSourceList[i].Type == "influxdb" {
+				dataSourceList[i].Password = config.influxdbPassword
 			}
-			out = "(" + out + ")" + select_.Params[0] // e.g. "(x)/2"
-		} else {
-			log.Fatalf("Unexpected select type = '%s'", select_.Type)
 		}
+		return NewDataSources(dataSourceList, config.queryTimeout)
 	}
 
-	return out
+	if config.dataSourcesPath == "" {
+		url := "http://" + config.influxdbHostname + ":" + config.influxdbPort
+		dataSourceList := []DataSource{{
+			Name:      "InfluxDB",
+			Type:      "influxdb",
+			Url:       url,
+			Database:  config.influxdbDatabase,
+			User:      config.influxdbUsername,
+			Password:  config.influxdbPassword,
+			IsDefault: true,
+		}}
+		for name, database := range LEGACY_DATABASES {
+			dataSourceList = append(dataSourceList, DataSource{
+				Name:     name,
+				Type:     "influxdb",
+				Url:      url,
+				Database: database,
+				User:     config.influxdbUsername,
+				Password: config.influxdbPassword,
+			})
+		}
+		return NewDataSources(dataSourceList, config.queryTimeout)
+	}
+
+	dataSourcesReader, err := os.Open(config.dataSourcesPath)
+	if err != nil {
+		log.Fatalf("Error from Open: %s", err)
+	}
+	defer dataSourcesReader.Close()
+	return parseDataSourcesJson(dataSourcesReader, config.queryTimeout)
+}
+
+// The report's range, unless it uses dashboard time and the dashboard has
+// a valid saved range of its own
+func dashboardTimeRange(report ReportConfig, dashboard Dashboard, now time.Time) TimeRange {
+	if report.useDashboardTime && dashboard.Time.From != "" && dashboard.Time.To != "" {
+		timeRange, err := parseTimeRange(dashboard.Time.From, dashboard.Time.To, now)
+		if err == nil {
+			return timeRange
+		}
+		log.Printf("Ignoring time range of dashboard '%s': %s", dashboard.Title, err)
+	}
+
+	timeRange, err := parseTimeRange(report.from, report.to, now)
+	if err != nil {
+		log.Fatalf("Error from parseTimeRange: %s", err)
+	}
+	return timeRange
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var LEGEND_FORMAT_PATTERN = regexp.MustCompile(`\{\{\s*(.+?)\s*\}\}`)
+
+type PrometheusResponse struct {
+	Status    string                 `json:"status"`
+	ErrorType string                 `json:"errorType"`
+	Error     string                 `json:"error"`
+	Data      PrometheusResponseData `json:"data"`
+}
+
+type PrometheusResponseData struct {
+	ResultType string             `json:"resultType"`
+	Result     []PrometheusMatrix `json:"result"`
+}
+
+type PrometheusMatrix struct {
+	Metric map[string]string `json:"metric"`
+	Values [][]interface{}   `json:"values"`
+}
+
+// Like Grafana, the step is the panel's interval (but at least the target's
+// own minimum interval) times the target's interval factor
+func prometheusStep(target Target, interval time.Duration) time.Duration {
+	step := interval
+	if target.Interval != "" {
+		minInterval := target.Interval
+		if minInterval[0] == '>' {
+			minInterval = minInterval[1:]
+		}
+		if minStep, err := parseInterval(minInterval); err == nil && step < minStep {
+			step = minStep
+		}
+	}
+	if target.IntervalFactor > 1 {
+		step *= time.Duration(target.IntervalFactor)
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+	return step
+}
+
+// Runs expr through /api/v1/query_range and returns one series per metric,
+// named from legendFormat
+func queryPrometheus(ctx context.Context, dataSource *DataSource, expr, legendFormat string,
+	start, end time.Time, step time.Duration) ([]Series, error) {
+
+	params := url.Values{}
+	params.Set("query", expr)
+	params.Set("start", strconv.FormatInt(start.Unix(), 10))
+	params.Set("end", strconv.FormatInt(end.Unix(), 10))
+	params.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+	queryUrl := strings.TrimRight(dataSource.Url, "/") + "/api/v1/query_range?" +
+		params.Encode()
+	log.Printf("Query is %s", queryUrl)
+
+	request, err := http.NewRequest("GET", queryUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error from NewRequest: %s", err)
+	}
+	request = request.WithContext(ctx)
+	if dataSource.bearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+dataSource.bearerToken)
+	} else if dataSource.BasicAuth {
+		request.SetBasicAuth(dataSource.BasicAuthUser, dataSource.BasicAuthPassword)
+	}
+
+	response, err := dataSource.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Error from GET %s: %s", queryUrl, err)
+	}
+	defer response.Body.Close()
+
+	var decoded PrometheusResponse
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("Error decoding response with status %s from %s: %s",
+			response.Status, queryUrl, err)
+	}
+	if decoded.Status != "success" {
+		return nil, fmt.Errorf("Error from Prometheus for query %s: %s: %s",
+			expr, decoded.ErrorType, decoded.Error)
+	}
+	if decoded.Data.ResultType != "matrix" {
+		return nil, fmt.Errorf("Expected resultType matrix but got %s for query %s",
+			decoded.Data.ResultType, expr)
+	}
+
+	allSeries := []Series{}
+	for _, matrix := range decoded.Data.Result {
+		seriesPoints := []Point{}
+		for _, pair := range matrix.Values {
+			point, err := parsePrometheusValue(pair)
+			if err != nil {
+				return nil, fmt.Errorf("%s in query %s", err, expr)
+			}
+			if !math.IsNaN(point.Value) {
+				seriesPoints = append(seriesPoints, point)
+			}
+		}
+		allSeries = append(allSeries, Series{
+			Name:        prometheusSeriesName(matrix.Metric, legendFormat),
+			Measurement: matrix.Metric["__name__"],
+			Tags:        matrix.Metric,
+			Points:      seriesPoints,
+		})
+	}
+	return allSeries, nil
+}
+
+// Parses a [<unix seconds>, "<value>"] pair
+func parsePrometheusValue(pair []interface{}) (Point, error) {
+	if len(pair) != 2 {
+		return Point{}, fmt.Errorf("Expected value pair but got %v", pair)
+	}
+	seconds, ok := pair[0].(float64)
+	if !ok {
+		return Point{}, fmt.Errorf("Expected numeric timestamp but got %v", pair[0])
+	}
+	valueString, ok := pair[1].(string)
+	if !ok {
+		return Point{}, fmt.Errorf("Expected string value but got %v", pair[1])
+	}
+	value, err := strconv.ParseFloat(valueString, 64)
+	if err != nil {
+		return Point{}, fmt.Errorf("Error from ParseFloat of %s", valueString)
+	}
+
+	return Point{
+		Time:  time.Unix(0, int64(seconds*1e9)).UTC(),
+		Value: value,
+	}, nil
+}
+
+// Expands {{label}} in legendFormat, or formats the whole metric like
+// Prometheus does, e.g. up{instance="a",job="b"}
+func prometheusSeriesName(metric map[string]string, legendFormat string) string {
+	if legendFormat != "" {
+		return LEGEND_FORMAT_PATTERN.ReplaceAllStringFunc(legendFormat,
+			func(match string) string {
+				label := LEGEND_FORMAT_PATTERN.FindStringSubmatch(match)[1]
+				return metric[label]
+			})
+	}
+
+	labels := []string{}
+	for label, value := range metric {
+		if label != "__name__" {
+			labels = append(labels, fmt.Sprintf("%s=%q", label, value))
+		}
+	}
+	sort.Strings(labels)
+	return metric["__name__"] + "{" + strings.Join(labels, ",") + "}"
+}
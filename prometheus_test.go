@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const PROMETHEUS_MATRIX = `{
+  "status": "success",
+  "data": {
+    "resultType": "matrix",
+    "result": [
+      {
+        "metric": {"__name__": "up", "instance": "web-1:9100", "job": "node"},
+        "values": [[1600000000, "1"], [1600000060, "NaN"], [1600000120, "+Inf"]]
+      },
+      {
+        "metric": {"__name__": "up", "instance": "web-2:9100", "job": "node"},
+        "values": [[1600000000.5, "0.25"]]
+      }
+    ]
+  }
+}`
+
+// Sets up the datasource the way NewDataSources does for real ones
+func newPrometheusDataSource(dataSource DataSource, queryTimeout time.Duration) *DataSource {
+	dataSource.Name = "Prometheus"
+	dataSource.Type = "prometheus"
+	dataSources := NewDataSources([]DataSource{dataSource}, queryTimeout)
+	return dataSources.byName["Prometheus"]
+}
+
+func newPrometheusServer(t *testing.T, status int, body string,
+	requests *[]*http.Request) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/v1/query_range" {
+				t.Errorf("Unexpected path %s", r.URL.Path)
+			}
+			*requests = append(*requests, r)
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+}
+
+func TestPrometheusStep(t *testing.T) {
+	tests := []struct {
+		interval       string
+		intervalFactor int
+		panelInterval  time.Duration
+		expected       time.Duration
+	}{
+		{"", 0, time.Minute, time.Minute},
+		{"", 1, time.Minute, time.Minute},
+		{"", 2, time.Minute, 2 * time.Minute},
+		{"5m", 0, time.Minute, 5 * time.Minute},
+		{">5m", 0, time.Minute, 5 * time.Minute},
+		{"30s", 0, time.Minute, time.Minute},
+		{"30s", 3, 10 * time.Second, 90 * time.Second},
+		{"", 0, 100 * time.Millisecond, time.Second},
+		{"bogus", 0, time.Minute, time.Minute},
+	}
+	for _, test := range tests {
+		target := Target{Interval: test.interval, IntervalFactor: test.intervalFactor}
+		actual := prometheusStep(target, test.panelInterval)
+		if actual != test.expected {
+			t.Errorf("prometheusStep(%+v, %s) = %s, expected %s",
+				target, test.panelInterval, actual, test.expected)
+		}
+	}
+}
+
+func TestQueryPrometheus(t *testing.T) {
+	requests := []*http.Request{}
+	server := newPrometheusServer(t, http.StatusOK, PROMETHEUS_MATRIX, &requests)
+	defer server.Close()
+
+	start := time.Unix(1600000000, 0)
+	end := time.Unix(1600003600, 0)
+	allSeries, err := queryPrometheus(context.Background(),
+		newPrometheusDataSource(DataSource{Url: server.URL + "/"}, time.Second), `up{job="node"}`,
+		"{{instance}} ({{ job }})", start, end, 90*time.Second)
+	if err != nil {
+		t.Fatalf("Error from queryPrometheus: %s", err)
+	}
+
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request but got %d", len(requests))
+	}
+	params := requests[0].URL.Query()
+	for name, expected := range map[string]string{
+		"query": `up{job="node"}`,
+		"start": "1600000000",
+		"end":   "1600003600",
+		"step":  "90",
+	} {
+		if params.Get(name) != expected {
+			t.Errorf("Expected %s=%s but got %s", name, expected, params.Get(name))
+		}
+	}
+
+	if len(allSeries) != 2 {
+		t.Fatalf("Expected 2 series but got %d", len(allSeries))
+	}
+	if allSeries[0].Name != "web-1:9100 (node)" || allSeries[1].Name != "web-2:9100 (node)" {
+		t.Errorf("Unexpected names %s and %s", allSeries[0].Name, allSeries[1].Name)
+	}
+	if allSeries[0].Measurement != "up" || allSeries[0].Tags["job"] != "node" {
+		t.Errorf("Unexpected measurement or tags: %+v", allSeries[0])
+	}
+
+	points := allSeries[0].Points
+	if len(points) != 2 {
+		t.Fatalf("Expected the NaN sample to be dropped but got %+v", points)
+	}
+	if !points[0].Time.Equal(start) || points[0].Value != 1 {
+		t.Errorf("Unexpected first point %+v", points[0])
+	}
+	if !points[1].Time.Equal(time.Unix(1600000120, 0)) || !math.IsInf(points[1].Value, 1) {
+		t.Errorf("Expected +Inf at 1600000120 but got %+v", points[1])
+	}
+
+	points = allSeries[1].Points
+	if len(points) != 1 || !points[0].Time.Equal(time.Unix(1600000000, 5e8)) ||
+		points[0].Value != 0.25 {
+		t.Errorf("Unexpected points %+v", points)
+	}
+}
+
+func TestQueryPrometheusWithoutLegendFormat(t *testing.T) {
+	requests := []*http.Request{}
+	server := newPrometheusServer(t, http.StatusOK, PROMETHEUS_MATRIX, &requests)
+	defer server.Close()
+
+	allSeries, err := queryPrometheus(context.Background(), newPrometheusDataSource(DataSource{Url: server.URL}, time.Second),
+		"up", "", time.Unix(1600000000, 0), time.Unix(1600003600, 0), time.Minute)
+	if err != nil {
+		t.Fatalf("Error from queryPrometheus: %s", err)
+	}
+	expected := `up{instance="web-1:9100",job="node"}`
+	if allSeries[0].Name != expected {
+		t.Errorf("Expected name %s but got %s", expected, allSeries[0].Name)
+	}
+}
+
+func TestQueryPrometheusBasicAuth(t *testing.T) {
+	requests := []*http.Request{}
+	server := newPrometheusServer(t, http.StatusOK, PROMETHEUS_MATRIX, &requests)
+	defer server.Close()
+
+	dataSource := newPrometheusDataSource(DataSource{
+		Url:               server.URL,
+		BasicAuth:         true,
+		BasicAuthUser:     "grafana",
+		BasicAuthPassword: "secret",
+	}, time.Second)
+	_, err := queryPrometheus(context.Background(), dataSource, "up", "",
+		time.Unix(1600000000, 0), time.Unix(1600003600, 0), time.Minute)
+	if err != nil {
+		t.Fatalf("Error from queryPrometheus: %s", err)
+	}
+	user, password, ok := requests[0].BasicAuth()
+	if !ok || user != "grafana" || password != "secret" {
+		t.Errorf("Expected basic auth grafana:secret but got %s:%s", user, password)
+	}
+}
+
+func TestQueryPrometheusErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		expected string
+	}{
+		{"bad query", http.StatusBadRequest,
+			`{"status":"error","errorType":"bad_data","error":"parse error at char 3"}`,
+			"bad_data: parse error at char 3"},
+		{"timeout", http.StatusServiceUnavailable,
+			`{"status":"error","errorType":"timeout","error":"query timed out"}`,
+			"timeout: query timed out"},
+		{"not json", http.StatusBadGateway, "502 Bad Gateway",
+			"Error decoding response with status 502 Bad Gateway"},
+		{"vector", http.StatusOK,
+			`{"status":"success","data":{"resultType":"vector","result":[]}}`,
+			"Expected resultType matrix but got vector"},
+		{"bad value", http.StatusOK,
+			`{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{},"values":[[1600000000,"abc"]]}]}}`,
+			"Error from ParseFloat of abc"},
+		{"numeric value", http.StatusOK,
+			`{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{},"values":[[1600000000,1]]}]}}`,
+			"Expected string value"},
+	}
+	for _, test := range tests {
+		requests := []*http.Request{}
+		server := newPrometheusServer(t, test.status, test.body, &requests)
+		_, err := queryPrometheus(context.Background(), newPrometheusDataSource(DataSource{Url: server.URL}, time.Second),
+			"up", "", time.Unix(1600000000, 0), time.Unix(1600003600, 0), time.Minute)
+		server.Close()
+
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		} else if !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected error containing %q but got %q",
+				test.name, test.expected, err)
+		}
+	}
+}
+
+func TestQueryPrometheusUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	_, err := queryPrometheus(context.Background(), newPrometheusDataSource(DataSource{Url: url}, time.Second), "up", "",
+		time.Unix(1600000000, 0), time.Unix(1600003600, 0), time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "Error from GET") {
+		t.Errorf("Expected a GET error but got %v", err)
+	}
+}
+
+func TestQueryPrometheusTimeout(t *testing.T) {
+	stop := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			<-stop
+		}))
+	defer server.Close()
+	defer close(stop)
+
+	// Without a deadline on the context, only the client's timeout ends it
+	_, err := queryPrometheus(context.Background(),
+		newPrometheusDataSource(DataSource{Url: server.URL}, 50*time.Millisecond), "up", "",
+		time.Unix(1600000000, 0), time.Unix(1600003600, 0), time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Errorf("Expected a timeout error but got %v", err)
+	}
+}
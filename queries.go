@@ -1,15 +1,111 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"math"
 	"time"
 
 	clientPkg "github.com/influxdata/influxdb/client/v2"
 )
 
-// Possibly returns multiple series if you select across multiple tags
-func query(client clientPkg.Client, databaseName, command string) [][]Point {
+// Possibly returns multiple series if you select across multiple tags, and
+// one series per value column if you select multiple fields
+func query(client clientPkg.Client, databaseName, command string) ([]Series, error) {
+	result, err := runQuery(client, databaseName, command)
+	if err != nil {
+		return nil, err
+	}
+
+	allSeries := []Series{}
+	for _, series := range result.Series {
+		if len(series.Columns) < 2 {
+			return nil, fmt.Errorf("Expected at least 2 columns, but got %d in command %s", len(series.Columns), command)
+		}
+		if series.Columns[0] != "time" {
+			return nil, fmt.Errorf("Expected Columns[0] to be 'time', but was %s in command %s", series.Columns[0], command)
+		}
+
+		columnPoints := make([][]Point, len(series.Columns)-1)
+		for _, row := range series.Values {
+			timeNumber, ok := row[0].(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("Expected number for time but got %v", row[0])
+			}
+			timeNanos, err := timeNumber.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("Error from Int64 of %v", row[0])
+			}
+
+			for column := 1; column < len(row) && column < len(series.Columns); column++ {
+				point := Point{Time: time.Unix(0, timeNanos).UTC()}
+				if row[column] == nil {
+					// Kept so the chart can show the gap, e.g. with fill(null)
+					point.Value = math.NaN()
+					columnPoints[column-1] = append(columnPoints[column-1], point)
+					continue
+				}
+				valueNumber, ok := row[column].(json.Number)
+				if !ok {
+					return nil, fmt.Errorf("Expected number for %s but got %v",
+						series.Columns[column], row[column])
+				}
+				point.Value, err = valueNumber.Float64()
+				if err != nil {
+					return nil, fmt.Errorf("Error from Float64 of %v", row[column])
+				}
+				columnPoints[column-1] = append(columnPoints[column-1], point)
+			}
+		}
+
+		for i, points := range columnPoints {
+			allSeries = append(allSeries, Series{
+				Measurement: series.Name,
+				Column:      series.Columns[i+1],
+				Tags:        series.Tags,
+				Points:      points,
+			})
+		}
+	}
+
+	return allSeries, nil
+}
+
+// Values for a query variable, from the value column of SHOW TAG VALUES or
+// the first column of anything else, e.g. SHOW MEASUREMENTS
+func queryValues(client clientPkg.Client, databaseName, command string) ([]string, error) {
+	result, err := runQuery(client, databaseName, command)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []string{}
+	seen := map[string]bool{}
+	for _, series := range result.Series {
+		column := 0
+		for i, name := range series.Columns {
+			if name == "value" {
+				column = i
+			}
+		}
+
+		for _, row := range series.Values {
+			if column >= len(row) || row[column] == nil {
+				continue
+			}
+			value := fmt.Sprintf("%v", row[column])
+			if !seen[value] {
+				values = append(values, value)
+				seen[value] = true
+			}
+		}
+	}
+	return values, nil
+}
+
+func runQuery(client clientPkg.Client, databaseName, command string) (clientPkg.Result, error) {
 	log.Printf("Query is %s", command)
 
 	q := clientPkg.Query{
@@ -19,56 +115,64 @@ func query(client clientPkg.Client, databaseName, command string) [][]Point {
 	}
 	response, err := client.Query(q)
 	if err != nil {
-		log.Fatalf("Error from Query with command %s: %s", command, err)
+		return clientPkg.Result{}, fmt.Errorf("Error from Query with command %s: %s", command, err)
 	}
 
 	if response.Error() != nil {
-		log.Fatalf("Error from Error with command %s: %s", command, response.Error())
+		return clientPkg.Result{}, fmt.Errorf("Error from Error with command %s: %s", command, response.Error())
 	}
 
 	if len(response.Results) != 1 {
-		log.Fatalf("Expected len(Results) to be 1, but was %d in command %s", len(response.Results), command)
+		return clientPkg.Result{}, fmt.Errorf("Expected len(Results) to be 1, but was %d in command %s", len(response.Results), command)
 	}
 	result := response.Results[0]
 
 	if len(result.Messages) > 0 {
-		log.Fatalf("Unexpected messages in result for command %s: %v", command, result.Messages)
+		return clientPkg.Result{}, fmt.Errorf("Unexpected messages in result for command %s: %v", command, result.Messages)
 	}
 	if len(result.Err) > 0 {
-		log.Fatalf("Unexpected Err in result for command %s: %v", command, result.Err)
+		return clientPkg.Result{}, fmt.Errorf("Unexpected Err in result for command %s: %v", command, result.Err)
 	}
+	return result, nil
+}
 
-	allPoints := [][]Point{}
-	for _, series := range result.Series {
-		seriesPoints := []Point{}
-		if len(series.Columns) != 2 {
-			log.Fatalf("Expected len(Columns) to be 2, but was %d in command %s", len(series.Columns), command)
-		}
-		if series.Columns[0] != "time" {
-			log.Fatalf("Expected Columns[0] to be 'time', but was %s in command %s", series.Columns[0], command)
-		}
+// Runs query in the background so the caller can stop waiting when ctx is
+// done, since the InfluxDB client can't take a context; the client's own
+// timeout (see NewDataSources) then ends the abandoned request
+func queryWithContext(ctx context.Context, client clientPkg.Client,
+	databaseName, command string) ([]Series, error) {
 
-		for _, row := range series.Values {
-			timeNanos, err := row[0].(json.Number).Int64()
-			if err != nil {
-				log.Fatalf("Error from Float64 of %v", row[0])
-			}
+	var series []Series
+	err := waitWithContext(ctx, command, func() error {
+		var err error
+		series, err = query(client, databaseName, command)
+		return err
+	})
+	return series, err
+}
 
-			if row[1] != nil {
-				value, err := row[1].(json.Number).Float64()
-				if err != nil {
-					log.Fatalf("Error from Float64 of %v", row[1])
-				}
+func queryValuesWithContext(ctx context.Context, client clientPkg.Client,
+	databaseName, command string) ([]string, error) {
 
-				point := Point{
-					Time:  time.Unix(0, timeNanos).UTC(),
-					Value: value,
-				}
-				seriesPoints = append(seriesPoints, point)
-			}
-		}
-		allPoints = append(allPoints, seriesPoints)
-	}
+	var values []string
+	err := waitWithContext(ctx, command, func() error {
+		var err error
+		values, err = queryValues(client, databaseName, command)
+		return err
+	})
+	return values, err
+}
+
+func waitWithContext(ctx context.Context, command string, run func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- run()
+	}()
 
-	return allPoints
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("Gave up on query %s: %s", command, ctx.Err())
+	}
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How to render one kind of part from Grafana's InfluxDB query editor,
+// given the expression built from the parts before it
+type QueryPart struct {
+	defaultParams []string // also the most params the part takes
+	render        func(partType, inner string, params []string) string
+}
+
+// Grafana's catalog of select parts
+var QUERY_PARTS = map[string]QueryPart{
+	"field": {[]string{"value"}, renderField},
+
+	// Aggregations
+	"count":    {nil, renderFunction},
+	"distinct": {nil, renderFunction},
+	"integral": {nil, renderFunction},
+	"mean":     {nil, renderFunction},
+	"median":   {nil, renderFunction},
+	"mode":     {nil, renderFunction},
+	"sum":      {nil, renderFunction},
+
+	// Selectors
+	"bottom":     {[]string{"3"}, renderFunction},
+	"first":      {nil, renderFunction},
+	"last":       {nil, renderFunction},
+	"max":        {nil, renderFunction},
+	"min":        {nil, renderFunction},
+	"percentile": {[]string{"95"}, renderFunction},
+	"top":        {[]string{"3"}, renderFunction},
+
+	// Transformations
+	"derivative":              {[]string{"10s"}, renderFunction},
+	"spread":                  {nil, renderFunction},
+	"non_negative_derivative": {[]string{"10s"}, renderFunction},
+	"difference":              {nil, renderFunction},
+	"non_negative_difference": {nil, renderFunction},
+	"moving_average":          {[]string{"5"}, renderFunction},
+	"cumulative_sum":          {nil, renderFunction},
+	"stddev":                  {nil, renderFunction},
+	"elapsed":                 {[]string{"10s"}, renderFunction},
+
+	// Predictors
+	"holt_winters":          {[]string{"10", "2"}, renderFunction},
+	"holt_winters_with_fit": {[]string{"10", "2"}, renderFunction},
+
+	"math":  {[]string{" / 100"}, renderMath},
+	"alias": {[]string{"alias"}, renderAlias},
+}
+
+func renderField(partType, inner string, params []string) string {
+	return quoteIdentifier(params[0])
+}
+
+// e.g. percentile(value, 95)
+func renderFunction(partType, inner string, params []string) string {
+	return partType + "(" + strings.Join(append([]string{inner}, params...), ", ") + ")"
+}
+
+// e.g. mean(value) / 100
+func renderMath(partType, inner string, params []string) string {
+	return inner + " " + strings.TrimSpace(params[0])
+}
+
+func renderAlias(partType, inner string, params []string) string {
+	return inner + ` AS "` + strings.Replace(params[0], `"`, `\"`, -1) + `"`
+}
+
+// Builds the SELECT list from the query editor's select groups, one
+// expression per group, e.g. "mean(rx), mean(tx)"
+func selectsToSelect(selects [][]Select) (string, error) {
+	if len(selects) == 0 {
+		return "", fmt.Errorf("Expected at least one select group")
+	}
+
+	expressions := []string{}
+	for _, selectGroup := range selects {
+		expression, err := selectGroupToExpression(selectGroup)
+		if err != nil {
+			return "", err
+		}
+		expressions = append(expressions, expression)
+	}
+	return strings.Join(expressions, ", "), nil
+}
+
+// Applies a group's parts in order, starting from its field; an alias
+// always goes last, wherever it appears
+func selectGroupToExpression(selectGroup []Select) (string, error) {
+	if len(selectGroup) == 0 || selectGroup[0].Type != "field" {
+		return "", fmt.Errorf("Select group must start with a field; it is %+v", selectGroup)
+	}
+
+	out := ""
+	alias := ""
+	for i, select_ := range selectGroup {
+		if select_.Type == "field" && i > 0 {
+			return "", fmt.Errorf("Select with type=field must be first; selects is %+v", selectGroup)
+		}
+
+		part, found := QUERY_PARTS[select_.Type]
+		if !found {
+			return "", fmt.Errorf("Unexpected select type = '%s'", select_.Type)
+		}
+		params, err := queryPartParams(select_, part)
+		if err != nil {
+			return "", err
+		}
+
+		if select_.Type == "alias" {
+			alias = params[0]
+			continue
+		}
+		out = part.render(select_.Type, out, params)
+	}
+
+	if alias != "" {
+		out = renderAlias("alias", out, []string{alias})
+	}
+	return out, nil
+}
+
+// The part's params, with Grafana's defaults for any left blank or missing
+func queryPartParams(select_ Select, part QueryPart) ([]string, error) {
+	if len(select_.Params) > len(part.defaultParams) {
+		return nil, fmt.Errorf("Expected at most %d params for %s but got %d",
+			len(part.defaultParams), select_.Type, len(select_.Params))
+	}
+
+	params := append([]string{}, part.defaultParams...)
+	for i, param := range select_.Params {
+		if strings.TrimSpace(param) != "" {
+			params[i] = param
+		}
+	}
+	return params, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const TEST_TIME_FILTER = "time >= 1600000000000ms and time <= 1600086400000ms"
+
+// Parses a panel as Grafana saves it and builds its first target's InfluxQL
+func panelCommand(t *testing.T, panelJson string) (string, error) {
+	panel := Panel{}
+	if err := json.Unmarshal([]byte(panelJson), &panel); err != nil {
+		t.Fatalf("Error from Unmarshal: %s", err)
+	}
+	vars := queryVariables(map[string][]string{"host": {"web-1"}}, nil,
+		time.Unix(1600000000, 0), time.Unix(1600086400, 0), time.Minute)
+	return targetToCommand(panel.Targets[0], vars)
+}
+
+// A panel with one target, whose select and groupBy are given as JSON
+func targetPanelJson(selectJson, groupByJson string) string {
+	return `{
+      "datasource": "InfluxDB",
+      "title": "Network",
+      "type": "graph",
+      "targets": [
+        {
+          "dsType": "influxdb",
+          "measurement": "net",
+          "policy": "default",
+          "refId": "A",
+          "resultFormat": "time_series",
+          "orderByTime": "ASC",
+          "select": ` + selectJson + `,
+          "groupBy": ` + groupByJson + `,
+          "tags": [{"key": "host", "operator": "=~", "value": "/^$host$/"}]
+        }
+      ]
+    }`
+}
+
+const DEFAULT_GROUP_BY_JSON = `[
+  {"params": ["$__interval"], "type": "time"},
+  {"params": ["null"], "type": "fill"}
+]`
+
+func TestSelectParts(t *testing.T) {
+	tests := []struct {
+		name       string
+		selectJson string
+		expected   string
+	}{
+		{"field only",
+			`[[{"params": ["bytes_recv"], "type": "field"}]]`,
+			`"bytes_recv"`},
+		{"aggregation",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"}]]`,
+			`mean("bytes_recv")`},
+		{"selector with numeric param",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [99], "type": "percentile"}]]`,
+			`percentile("bytes_recv", 99)`},
+		{"selector with default param",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "top"}]]`,
+			`top("bytes_recv", 3)`},
+		{"blank param takes the default",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [""], "type": "bottom"}]]`,
+			`bottom("bytes_recv", 3)`},
+		{"transformation of an aggregation",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"},
+			  {"params": ["1s"], "type": "non_negative_derivative"}]]`,
+			`non_negative_derivative(mean("bytes_recv"), 1s)`},
+		{"transformation of a selector",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "max"},
+			  {"params": [], "type": "difference"}]]`,
+			`difference(max("bytes_recv"))`},
+		{"selector after a transformation",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"},
+			  {"params": ["10s"], "type": "derivative"}, {"params": [], "type": "last"}]]`,
+			`last(derivative(mean("bytes_recv"), 10s))`},
+		{"predictor",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"},
+			  {"params": ["30", "4"], "type": "holt_winters"}]]`,
+			`holt_winters(mean("bytes_recv"), 30, 4)`},
+		{"math",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"},
+			  {"params": ["*8"], "type": "math"}]]`,
+			`mean("bytes_recv") *8`},
+		{"default math",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"},
+			  {"params": [], "type": "math"}]]`,
+			`mean("bytes_recv") / 100`},
+		{"math after a transformation",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"},
+			  {"params": ["1s"], "type": "non_negative_derivative"}, {"params": [" * 8"], "type": "math"}]]`,
+			`non_negative_derivative(mean("bytes_recv"), 1s) * 8`},
+		{"alias",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"},
+			  {"params": ["received"], "type": "alias"}]]`,
+			`mean("bytes_recv") AS "received"`},
+		{"alias before math still goes last",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"},
+			  {"params": ["bits"], "type": "alias"}, {"params": ["*8"], "type": "math"}]]`,
+			`mean("bytes_recv") *8 AS "bits"`},
+		{"alias with a quote",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"},
+			  {"params": ["say \"hi\""], "type": "alias"}]]`,
+			`mean("bytes_recv") AS "say \"hi\""`},
+		{"field needing quotes",
+			`[[{"params": ["bytes \"recv\""], "type": "field"}, {"params": [], "type": "sum"}]]`,
+			`sum("bytes \"recv\"")`},
+		{"multiple select groups",
+			`[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"},
+			   {"params": ["in"], "type": "alias"}],
+			  [{"params": ["bytes_sent"], "type": "field"}, {"params": [], "type": "mean"},
+			   {"params": ["out"], "type": "alias"}]]`,
+			`mean("bytes_recv") AS "in", mean("bytes_sent") AS "out"`},
+	}
+	for _, test := range tests {
+		command, err := panelCommand(t, targetPanelJson(test.selectJson, DEFAULT_GROUP_BY_JSON))
+		if err != nil {
+			t.Errorf("%s: error from targetToCommand: %s", test.name, err)
+			continue
+		}
+		expected := `SELECT ` + test.expected + ` FROM "net" WHERE ("host" =~ /^web-1$/) AND ` +
+			TEST_TIME_FILTER + ` GROUP BY time(1m) fill(null)`
+		if command != expected {
+			t.Errorf("%s:\n got %s\nwant %s", test.name, command, expected)
+		}
+	}
+}
+
+func TestSelectPartErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		selectJson string
+		expected   string
+	}{
+		{"no select groups", `[]`, "Expected at least one select group"},
+		{"no field", `[[{"params": [], "type": "mean"}]]`, "must start with a field"},
+		{"second field",
+			`[[{"params": ["a"], "type": "field"}, {"params": ["b"], "type": "field"}]]`,
+			"type=field must be first"},
+		{"unknown part",
+			`[[{"params": ["a"], "type": "field"}, {"params": [], "type": "exponential"}]]`,
+			"Unexpected select type = 'exponential'"},
+		{"too many params",
+			`[[{"params": ["a"], "type": "field"}, {"params": ["1", "2"], "type": "percentile"}]]`,
+			"Expected at most 1 params for percentile but got 2"},
+	}
+	for _, test := range tests {
+		_, err := panelCommand(t, targetPanelJson(test.selectJson, DEFAULT_GROUP_BY_JSON))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected error containing %q but got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	tests := []struct {
+		name        string
+		groupByJson string
+		expected    string
+	}{
+		{"none", `[]`, ``},
+		{"interval", DEFAULT_GROUP_BY_JSON, ` GROUP BY time(1m) fill(null)`},
+		{"auto", `[{"params": ["auto"], "type": "time"}]`, ` GROUP BY time(1m)`},
+		{"fixed interval and tag",
+			`[{"params": ["5m"], "type": "time"}, {"params": ["host"], "type": "tag"},
+			  {"params": ["0"], "type": "fill"}]`,
+			` GROUP BY time(5m), "host" fill(0)`},
+		{"offset", `[{"params": ["$__interval", "5m"], "type": "time"}]`, ` GROUP BY time(1m, 5m)`},
+		{"negative offset", `[{"params": ["1h", "-15m"], "type": "time"}]`, ` GROUP BY time(1h, -15m)`},
+		{"blank offset", `[{"params": ["1h", ""], "type": "time"}]`, ` GROUP BY time(1h)`},
+		{"tag only", `[{"params": ["interface"], "type": "tag"}]`, ` GROUP BY "interface"`},
+		{"fill none", `[{"params": ["$__interval"], "type": "time"}, {"params": ["none"], "type": "fill"}]`,
+			` GROUP BY time(1m) fill(none)`},
+	}
+	selectJson := `[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"}]]`
+	for _, test := range tests {
+		command, err := panelCommand(t, targetPanelJson(selectJson, test.groupByJson))
+		if err != nil {
+			t.Errorf("%s: error from targetToCommand: %s", test.name, err)
+			continue
+		}
+		expected := `SELECT mean("bytes_recv") FROM "net" WHERE ("host" =~ /^web-1$/) AND ` +
+			TEST_TIME_FILTER + test.expected
+		if command != expected {
+			t.Errorf("%s:\n got %s\nwant %s", test.name, command, expected)
+		}
+	}
+}
+
+func TestGroupByErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		groupByJson string
+		expected    string
+	}{
+		{"bad interval", `[{"params": ["often"], "type": "time"}]`, "Bad GROUP BY time interval"},
+		{"bad offset", `[{"params": ["1h", "later"], "type": "time"}]`, "Bad GROUP BY time offset"},
+		{"bad fill", `[{"params": ["zero"], "type": "fill"}]`, "Unknown fill option 'zero'"},
+		{"unknown type", `[{"params": [], "type": "limit"}]`, "Unknown GroupBy Type 'limit'"},
+	}
+	selectJson := `[[{"params": ["bytes_recv"], "type": "field"}, {"params": [], "type": "mean"}]]`
+	for _, test := range tests {
+		_, err := panelCommand(t, targetPanelJson(selectJson, test.groupByJson))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected error containing %q but got %v", test.name, test.expected, err)
+		}
+	}
+}
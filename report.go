@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"sync"
+	"time"
+
+	chart "github.com/wcharczuk/go-chart"
+)
+
+// A dashboard's part of the report, with panels in dashboard order
+type DashboardReport struct {
+	Title  string
+	Panels []PanelResult
+}
+
+type PanelResult struct {
+	RowTitle string // blank if the row's title isn't shown
+	Title    string
+	Image    image.Image // nil if there's nothing to draw
+	Message  string      // shown instead of Image, e.g. "no points"
+	Err      error       // if set, Image is an error tile
+	Series   []Series
+	Table    *Table // for table panels, also drawn as Image
+}
+
+type panelJob struct {
+	dashboardNum int
+	panelNum     int
+	dashboard    Dashboard
+	rowTitle     string
+	panel        Panel
+	timeRange    TimeRange
+	variables    map[string][]string // template variables
+	tableMaxRows int
+}
+
+// Queries and draws every panel, config.concurrency panels at a time
+func renderReport(ctx context.Context, config Config, report ReportConfig,
+	dashboards []Dashboard, dataSources *DataSources, now time.Time) []DashboardReport {
+
+	// Load the font up front rather than letting the workers race to do it
+	if _, err := chart.GetDefaultFont(); err != nil {
+		log.Fatalf("Error from chart.GetDefaultFont: %s", err)
+	}
+
+	tableMaxRows := config.tableMaxRows
+	if report.tableMaxRows > 0 {
+		tableMaxRows = report.tableMaxRows
+	}
+
+	reports := make([]DashboardReport, len(dashboards))
+	jobs := []panelJob{}
+	for dashboardNum, dashboard := range dashboards {
+		timeRange := dashboardTimeRange(report, dashboard, now)
+
+		reports[dashboardNum].Title = dashboard.Title
+
+		vars, repeats, err := resolveVariables(ctx, config, dashboard,
+			report.variables, dataSources, timeRange)
+		if err != nil {
+			log.Printf("Error in dashboard '%s': %s", dashboard.Title, err)
+			reports[dashboardNum].Panels = []PanelResult{{
+				Title: "Template variables",
+				Image: drawErrorTile("Template variables", err),
+				Err:   err,
+			}}
+			continue
+		}
+
+		for _, row := range dashboard.Rows {
+			if row.RepeatRowId != 0 {
+				continue // a copy of a repeated row that Grafana saved
+			}
+
+			for _, rowVars := range repeatVariables(row.Repeat, vars, repeats) {
+				rowTitle := ""
+				if row.ShowTitle {
+					rowTitle = interpolateTitle(row.Title, rowVars)
+				}
+
+				for _, panel := range row.Panels {
+					if panel.RepeatPanelId != 0 ||
+						!report.selection.includesPanel(panel) ||
+						len(panel.Targets) == 0 {
+						continue
+					}
+
+					for _, panelVars := range repeatVariables(panel.Repeat, rowVars, repeats) {
+						repeatedPanel := panel
+						repeatedPanel.Title = interpolateTitle(panel.Title, panelVars)
+
+						jobs = append(jobs, panelJob{
+							dashboardNum: dashboardNum,
+							panelNum:     len(reports[dashboardNum].Panels),
+							dashboard:    dashboard,
+							rowTitle:     rowTitle,
+							panel:        repeatedPanel,
+							timeRange:    timeRange,
+							variables:    panelVars,
+							tableMaxRows: tableMaxRows,
+						})
+						reports[dashboardNum].Panels = append(reports[dashboardNum].Panels,
+							PanelResult{RowTitle: rowTitle, Title: repeatedPanel.Title})
+					}
+				}
+			}
+		}
+	}
+
+	jobChannel := make(chan panelJob)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < config.concurrency; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for job := range jobChannel {
+				result, err := renderPanel(ctx, config, job, dataSources)
+				if err != nil {
+					log.Printf("Error in panel '%s' of dashboard '%s': %s",
+						job.panel.Title, job.dashboard.Title, err)
+					result = PanelResult{
+						Title: job.panel.Title,
+						Image: drawErrorTile(job.panel.Title, err),
+						Err:   err,
+					}
+				}
+				result.RowTitle = job.rowTitle
+				reports[job.dashboardNum].Panels[job.panelNum] = result
+			}
+		}()
+	}
+	for _, job := range jobs {
+		jobChannel <- job
+	}
+	close(jobChannel)
+	waitGroup.Wait()
+
+	return reports
+}
+
+// Runs all of a panel's targets and draws their series on one chart, or
+// for a stat panel as a number, or for a table panel as a table
+func renderPanel(ctx context.Context, config Config, job panelJob,
+	dataSources *DataSources) (PanelResult, error) {
+
+	panel := job.panel
+	result := PanelResult{Title: panel.Title}
+
+	dataSource, err := dataSources.Lookup(string(panel.DataSource))
+	if err != nil {
+		return result, err
+	}
+	if dataSource.Type != "influxdb" && dataSource.Type != "prometheus" {
+		result.Image, err = drawMessageTile(panel.Title, fmt.Sprintf(
+			"Datasource '%s' has unsupported type '%s'",
+			dataSource.Name, dataSource.Type))
+		return result, err
+	}
+
+	minInterval := panel.Interval
+	if minInterval == "" {
+		minInterval = dataSource.JsonData.TimeInterval
+	}
+	interval, err := calculateInterval(job.timeRange, CHART_WIDTH, minInterval)
+	if err != nil {
+		return result, err
+	}
+
+	xMin := job.timeRange.From.UTC()
+	xMax := job.timeRange.To.UTC()
+	vars := queryVariables(job.variables, job.dashboard.Templating.List, xMin, xMax, interval)
+
+	allSeries := []Series{}
+	for _, target := range panel.Targets {
+		queryCtx, cancel := context.WithTimeout(ctx, config.queryTimeout)
+		series, err := queryTarget(queryCtx, dataSource, target, vars,
+			xMin, xMax, interval)
+		cancel()
+		if err != nil {
+			return result, err
+		}
+		allSeries = append(allSeries, series...)
+	}
+	for i := range allSeries {
+		allSeries[i].Format = seriesFormat(panel, allSeries[i].Name)
+	}
+
+	result.Series = allSeries
+	if panel.Type == "table" || panel.Type == "table-old" {
+		result.Table, err = buildTable(allSeries, panel, job.tableMaxRows)
+		if err != nil {
+			return result, err
+		}
+		result.Image, err = drawTable(result.Table, panel.Title)
+		if err != nil {
+			return result, err
+		}
+	} else if panel.Type == "singlestat" || panel.Type == "stat" {
+		result.Image, err = drawStat(allSeries, panel, xMin, xMax)
+		if err != nil {
+			return result, err
+		}
+	} else if len(allSeries) > 0 {
+		result.Image, err = drawChart(allSeries, panel, xMin, xMax)
+		if err != nil {
+			return result, err
+		}
+	} else {
+		result.Message = "no points"
+	}
+	return result, nil
+}
+
+func queryTarget(ctx context.Context, dataSource *DataSource, target Target,
+	vars QueryVariables, xMin, xMax time.Time,
+	interval time.Duration) ([]Series, error) {
+
+	if dataSource.Type == "prometheus" {
+		return queryPrometheus(ctx, dataSource, interpolateQuery(target.Expr, vars),
+			target.LegendFormat, xMin, xMax, prometheusStep(target, interval))
+	}
+
+	command, err := targetToCommand(target, vars)
+	if err != nil {
+		return nil, err
+	}
+	if command == "" {
+		return nil, fmt.Errorf("Blank query for target %+v", target)
+	}
+	series, err := queryWithContext(ctx, dataSource.influxdbClient,
+		dataSource.Database, command)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range series {
+		// Alias patterns go first, so a variable named e.g. m or col can't
+		// take the place of $m or $col
+		series[i].Name = influxSeriesName(series[i], target.Alias)
+		if target.Alias != "" {
+			series[i].Name = interpolateTitle(series[i].Name, vars.values)
+		}
+	}
+	return series, nil
+}
+
+// Lists each failed panel as "dashboard / panel: error"
+func summarizeFailures(reports []DashboardReport) []string {
+	failures := []string{}
+	for _, report := range reports {
+		for _, panel := range report.Panels {
+			if panel.Err != nil {
+				failures = append(failures, fmt.Sprintf("%s / %s: %s",
+					report.Title, panel.Title, panel.Err))
+			}
+		}
+	}
+	return failures
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image/png"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/danielstutzman/email-grafana-reports/units"
+)
+
+var REPORT_HTML_TEMPLATE = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: Helvetica, Arial, sans-serif; color: #333">
+{{range .Dashboards}}
+<h2 style="border-bottom: 1px solid #ccc">{{.Title}}</h2>
+{{range .Panels}}
+{{if .RowHeading}}<h3 style="color: #666">{{.RowHeading}}</h3>{{end}}
+<div style="margin-bottom: 16px">
+<h3 style="margin: 0 0 4px 0; font-size: 14px">{{.Title}}</h3>
+{{if .Err}}<p style="color: #d90074">Error: {{.Err}}</p>
+{{else if .Table}}<table style="border-collapse: collapse; font-size: 12px">
+<tr>{{range .Table.Headers}}<th style="text-align: left; padding: 2px 8px; border-bottom: 1px solid #ccc">{{.}}</th>{{end}}</tr>
+{{range .Table.Rows}}<tr>{{range .}}<td style="{{.Style}}">{{.Text}}</td>{{end}}</tr>
+{{end}}</table>
+{{if .Table.MoreRows}}<p style="color: #999">and {{.Table.MoreRows}} more rows</p>{{end}}
+{{else if .ImageUrl}}<img src="{{.ImageUrl}}" alt="{{.Title}}" width="{{.Width}}" height="{{.Height}}" style="max-width: 100%; height: auto">
+{{else}}<p style="color: #999">{{.Message}}</p>
+{{end}}</div>
+{{end}}{{end}}
+{{if .Failures}}
+<h2 style="color: #d90074">{{len .Failures}} panel(s) failed</h2>
+<ul>{{range .Failures}}<li>{{.}}</li>{{end}}</ul>
+{{end}}
+</body>
+</html>
+`))
+
+type htmlReport struct {
+	Dashboards []htmlDashboard
+	Failures   []string
+}
+
+type htmlDashboard struct {
+	Title  string
+	Panels []htmlPanel
+}
+
+type htmlPanel struct {
+	// The row's title, for the first panel of each row with a shown title
+	RowHeading string
+
+	Title    string
+	ImageUrl template.URL
+	Width    int
+	Height   int
+	Message  string
+	Err      error
+	Table    *htmlTable // shown instead of the image
+}
+
+type htmlTable struct {
+	Headers  []string
+	Rows     [][]htmlCell
+	MoreRows int
+}
+
+type htmlCell struct {
+	Text  string
+	Style template.CSS
+}
+
+func toHtmlTable(table *Table) *htmlTable {
+	html := &htmlTable{Headers: table.Headers, MoreRows: table.MoreRows}
+	for _, row := range table.Rows {
+		htmlRow := []htmlCell{}
+		for _, cell := range row {
+			style := "padding: 2px 8px; border-bottom: 1px solid #eee"
+			if !cell.Background.IsZero() {
+				style += "; background-color: " + cell.Background.String()
+			}
+			if !cell.Color.IsZero() {
+				style += "; color: " + cell.Color.String()
+			}
+			htmlRow = append(htmlRow, htmlCell{Text: cell.Text, Style: template.CSS(style)})
+		}
+		html.Rows = append(html.Rows, htmlRow)
+	}
+	return html
+}
+
+type inlineImage struct {
+	contentId string
+	filename  string
+	data      []byte
+}
+
+// Composes a multipart/related email: an HTML body showing each panel's
+// chart as an inline cid: image, a plain-text alternative summarizing each
+// series, and the images themselves
+func composeReportEmail(from string, recipients Recipients, subject string,
+	reports []DashboardReport,
+	failures []string) ([]byte, error) {
+
+	html := htmlReport{Failures: failures}
+	images := []inlineImage{}
+	for dashboardNum, report := range reports {
+		dashboard := htmlDashboard{Title: report.Title}
+		lastRowTitle := ""
+		for panelNum, panel := range report.Panels {
+			htmlPanel := htmlPanel{
+				Title:   panel.Title,
+				Message: panel.Message,
+				Err:     panel.Err,
+			}
+			if panel.RowTitle != lastRowTitle {
+				htmlPanel.RowHeading = panel.RowTitle
+				lastRowTitle = panel.RowTitle
+			}
+
+			if panel.Table != nil && panel.Err == nil {
+				htmlPanel.Table = toHtmlTable(panel.Table)
+			} else if panel.Image != nil && panel.Err == nil {
+				var pngBuffer bytes.Buffer
+				if err := png.Encode(&pngBuffer, panel.Image); err != nil {
+					return nil, fmt.Errorf("Error from png.Encode: %s", err)
+				}
+				contentId := fmt.Sprintf("panel-%d-%d@email-grafana-reports",
+					dashboardNum, panelNum)
+				images = append(images, inlineImage{
+					contentId: contentId,
+					filename:  fmt.Sprintf("panel-%d-%d.png", dashboardNum, panelNum),
+					data:      pngBuffer.Bytes(),
+				})
+				htmlPanel.ImageUrl = template.URL("cid:" + contentId)
+				htmlPanel.Width = panel.Image.Bounds().Dx()
+				htmlPanel.Height = panel.Image.Bounds().Dy()
+			}
+			dashboard.Panels = append(dashboard.Panels, htmlPanel)
+		}
+		html.Dashboards = append(html.Dashboards, dashboard)
+	}
+
+	var htmlBody bytes.Buffer
+	if err := REPORT_HTML_TEMPLATE.Execute(&htmlBody, html); err != nil {
+		return nil, fmt.Errorf("Error from REPORT_HTML_TEMPLATE.Execute: %s", err)
+	}
+	textBody := reportText(reports, failures)
+
+	// The alternative part is built first so its boundary is known
+	var alternative bytes.Buffer
+	alternativeWriter := multipart.NewWriter(&alternative)
+	if err := writeQuotedPrintablePart(alternativeWriter,
+		"text/plain; charset=utf-8", textBody); err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPrintablePart(alternativeWriter,
+		"text/html; charset=utf-8", htmlBody.String()); err != nil {
+		return nil, err
+	}
+	if err := alternativeWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	relatedWriter := multipart.NewWriter(&message)
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	if len(recipients.To) > 0 {
+		fmt.Fprintf(&message, "To: %s\r\n", formatAddressList(recipients.To))
+	}
+	if len(recipients.Cc) > 0 {
+		fmt.Fprintf(&message, "Cc: %s\r\n", formatAddressList(recipients.Cc))
+	}
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/related; type=\"multipart/alternative\"; boundary=%s\r\n\r\n",
+		relatedWriter.Boundary())
+
+	part, err := relatedWriter.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternativeWriter.Boundary()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(alternative.Bytes()); err != nil {
+		return nil, err
+	}
+
+	for _, image := range images {
+		part, err := relatedWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"image/png"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Id":                {"<" + image.contentId + ">"},
+			"Content-Disposition":       {"inline; filename=\"" + image.filename + "\""},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64Lines(part, image.data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := relatedWriter.Close(); err != nil {
+		return nil, err
+	}
+	return message.Bytes(), nil
+}
+
+func writeQuotedPrintablePart(writer *multipart.Writer, contentType, body string) error {
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	encoder := quotedprintable.NewWriter(part)
+	if _, err := encoder.Write([]byte(body)); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// Writes base64 in lines of 76 characters, as MIME requires
+func writeBase64Lines(part io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		lineLength := 76
+		if len(encoded) < lineLength {
+			lineLength = len(encoded)
+		}
+		if _, err := part.Write([]byte(encoded[:lineLength] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[lineLength:]
+	}
+	return nil
+}
+
+// Lists every panel with the current, min and max of each of its series
+func reportText(reports []DashboardReport, failures []string) string {
+	var text bytes.Buffer
+	for _, report := range reports {
+		fmt.Fprintf(&text, "%s\n%s\n\n", report.Title,
+			strings.Repeat("=", len(report.Title)))
+		lastRowTitle := ""
+		for _, panel := range report.Panels {
+			if panel.RowTitle != lastRowTitle {
+				if panel.RowTitle != "" {
+					fmt.Fprintf(&text, "-- %s --\n\n", panel.RowTitle)
+				}
+				lastRowTitle = panel.RowTitle
+			}
+			fmt.Fprintf(&text, "%s\n", panel.Title)
+			if panel.Err != nil {
+				fmt.Fprintf(&text, "  Error: %s\n", panel.Err)
+			} else if panel.Message != "" {
+				fmt.Fprintf(&text, "  (%s)\n", panel.Message)
+			}
+			for _, series := range panel.Series {
+				name := series.Name
+				if name == "" {
+					name = panel.Title
+				}
+				points := nonNullPoints(series.Points)
+				if len(points) == 0 {
+					fmt.Fprintf(&text, "  %s: no points\n", name)
+					continue
+				}
+				current, min, max := seriesStats(points)
+				fmt.Fprintf(&text, "  %s: current %s, min %s, max %s\n", name,
+					units.Format(current, series.Format, -1),
+					units.Format(min, series.Format, -1),
+					units.Format(max, series.Format, -1))
+			}
+			text.WriteString("\n")
+		}
+	}
+
+	if len(failures) > 0 {
+		fmt.Fprintf(&text, "%d panel(s) failed:\n", len(failures))
+		for _, failure := range failures {
+			fmt.Fprintf(&text, "- %s\n", failure)
+		}
+	}
+	return text.String()
+}
+
+// Returns the last, smallest and largest values; points must not be empty
+func seriesStats(points []Point) (current, min, max float64) {
+	min = math.MaxFloat64
+	max = -math.MaxFloat64
+	for _, point := range points {
+		if point.Value < min {
+			min = point.Value
+		}
+		if point.Value > max {
+			max = point.Value
+		}
+	}
+	return points[len(points)-1].Value, min, max
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Everything that differs between one report and the next; shared settings
+// like SMTP and datasources stay in Config
+type ReportConfig struct {
+	name             string
+	pngPath          string
+	from             string
+	to               string
+	useDashboardTime bool
+	selection        Selection
+	variables        map[string][]string // override dashboards' template variables
+	emailFrom        string
+	recipients       Recipients
+	emailSubject     *template.Template
+	doSendEmail      bool
+	schedule         *CronSchedule // nil if the report only runs on demand
+	tableMaxRows     int           // 0 to use -tableMaxRows
+}
+
+// Format of the -reportsConfigPath file
+type ReportsFile struct {
+	Reports []ReportJson `json:"reports"`
+}
+
+type ReportJson struct {
+	Name               string              `json:"name"`
+	PngPath            string              `json:"pngPath"`
+	Dashboards         []string            `json:"dashboards"`
+	ExcludeDashboards  []string            `json:"excludeDashboards"`
+	DashboardTags      []string            `json:"dashboardTags"`
+	Panels             string              `json:"panels"`
+	ExcludePanels      string              `json:"excludePanels"`
+	ExcludeDataSources []string            `json:"excludeDataSources"`
+	From               string              `json:"from"`
+	To                 string              `json:"to"`
+	UseDashboardTime   bool                `json:"useDashboardTime"`
+	Variables          map[string][]string `json:"variables"` // e.g. {"host": ["$__all"]}
+	EmailFrom          string              `json:"emailFrom"`
+	EmailTo            []string            `json:"emailTo"`
+	EmailCc            []string            `json:"emailCc"`
+	EmailBcc           []string            `json:"emailBcc"`
+	EmailSubject       string              `json:"emailSubject"`
+	Schedule           string              `json:"schedule"`     // cron expression for -serve
+	TimeZone           string              `json:"timeZone"`     // for schedule; blank means local
+	TableMaxRows       int                 `json:"tableMaxRows"` // blank means -tableMaxRows
+}
+
+// Fields available to an emailSubject template, e.g.
+// "Weekly report for {{.From.Format \"Jan 2\"}}"
+type SubjectData struct {
+	Name        string
+	From        time.Time
+	To          time.Time
+	NumFailures int
+}
+
+// Parses and validates every report in the file, returning all the problems
+// found rather than just the first. defaultEmailFrom is used for reports
+// that don't set emailFrom.
+func parseReportsConfig(reader io.Reader, defaultEmailFrom string,
+	smtpConfigured bool) ([]ReportConfig, error) {
+
+	var file ReportsFile
+	if err := json.NewDecoder(reader).Decode(&file); err != nil {
+		return nil, fmt.Errorf("Error from json.Decode: %s", err)
+	}
+	if len(file.Reports) == 0 {
+		return nil, fmt.Errorf("No reports defined")
+	}
+
+	problems := []string{}
+	seenNames := map[string]bool{}
+	reports := []ReportConfig{}
+	for i, reportJson := range file.Reports {
+		if reportJson.Name == "" {
+			problems = append(problems, fmt.Sprintf("Report #%d has no name", i+1))
+		} else if seenNames[reportJson.Name] {
+			problems = append(problems,
+				fmt.Sprintf("Report name '%s' is used more than once", reportJson.Name))
+		}
+		seenNames[reportJson.Name] = true
+
+		report, reportProblems := reportJson.toReportConfig(defaultEmailFrom, smtpConfigured)
+		for _, problem := range reportProblems {
+			problems = append(problems,
+				fmt.Sprintf("Report '%s': %s", reportJson.Name, problem))
+		}
+		reports = append(reports, report)
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return reports, nil
+}
+
+func (reportJson ReportJson) toReportConfig(defaultEmailFrom string,
+	smtpConfigured bool) (ReportConfig, []string) {
+
+	problems := []string{}
+	report := ReportConfig{
+		name:             reportJson.Name,
+		pngPath:          reportJson.PngPath,
+		from:             reportJson.From,
+		to:               reportJson.To,
+		useDashboardTime: reportJson.UseDashboardTime,
+		emailFrom:        reportJson.EmailFrom,
+		variables:        reportJson.Variables,
+		tableMaxRows:     reportJson.TableMaxRows,
+		selection: Selection{
+			Dashboards:         reportJson.Dashboards,
+			ExcludeDashboards:  reportJson.ExcludeDashboards,
+			DashboardTags:      reportJson.DashboardTags,
+			ExcludeDataSources: reportJson.ExcludeDataSources,
+		},
+	}
+	if report.from == "" {
+		report.from = "now-1d"
+	}
+	if report.to == "" {
+		report.to = "now"
+	}
+	if report.emailFrom == "" {
+		report.emailFrom = defaultEmailFrom
+	}
+
+	var err error
+	if reportJson.Panels != "" {
+		if report.selection.Panels, err = regexp.Compile(reportJson.Panels); err != nil {
+			problems = append(problems, fmt.Sprintf("Bad panels: %s", err))
+		}
+	}
+	if reportJson.ExcludePanels != "" {
+		if report.selection.ExcludePanels, err = regexp.Compile(reportJson.ExcludePanels); err != nil {
+			problems = append(problems, fmt.Sprintf("Bad excludePanels: %s", err))
+		}
+	}
+
+	if reportJson.Schedule != "" {
+		location, err := time.LoadLocation(reportJson.TimeZone)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Bad timeZone: %s", err))
+		} else if report.schedule, err = parseCronSchedule(reportJson.Schedule, location); err != nil {
+			problems = append(problems, fmt.Sprintf("Bad schedule: %s", err))
+		}
+	} else if reportJson.TimeZone != "" {
+		problems = append(problems, "Has a timeZone but no schedule")
+	}
+
+	if _, err := parseTimeRange(report.from, report.to, time.Now()); err != nil {
+		problems = append(problems, fmt.Sprintf("Bad from or to: %s", err))
+	}
+	if reportJson.TableMaxRows < 0 {
+		problems = append(problems, "tableMaxRows can't be negative")
+	}
+
+	report.doSendEmail = len(reportJson.EmailTo) > 0 ||
+		len(reportJson.EmailCc) > 0 ||
+		len(reportJson.EmailBcc) > 0
+	if report.doSendEmail {
+		if !smtpConfigured {
+			problems = append(problems, "Has recipients but -smtpHostPort isn't set")
+		}
+		if _, err := mail.ParseAddress(report.emailFrom); err != nil {
+			problems = append(problems,
+				fmt.Sprintf("Bad emailFrom '%s': %s", report.emailFrom, err))
+		}
+		report.recipients, err = parseRecipients(strings.Join(reportJson.EmailTo, ","),
+			strings.Join(reportJson.EmailCc, ","), strings.Join(reportJson.EmailBcc, ","))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Bad recipients: %s", err))
+		}
+		if reportJson.EmailSubject == "" {
+			problems = append(problems, "Has recipients but no emailSubject")
+		}
+	} else if report.pngPath == "" {
+		problems = append(problems, "Needs a pngPath or recipients, or it does nothing")
+	}
+
+	if report.emailSubject, err = parseSubjectTemplate(reportJson.EmailSubject); err != nil {
+		problems = append(problems, fmt.Sprintf("Bad emailSubject: %s", err))
+	}
+
+	return report, problems
+}
+
+func parseSubjectTemplate(subject string) (*template.Template, error) {
+	tmpl, err := template.New("subject").Option("missingkey=error").Parse(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	// Catch references to fields that don't exist now, not at send time
+	if err := tmpl.Execute(&bytes.Buffer{}, SubjectData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func (report ReportConfig) subject(timeRange TimeRange, numFailures int) (string, error) {
+	var buffer bytes.Buffer
+	err := report.emailSubject.Execute(&buffer, SubjectData{
+		Name:        report.name,
+		From:        timeRange.From,
+		To:          timeRange.To,
+		NumFailures: numFailures,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error from emailSubject template: %s", err)
+	}
+	return buffer.String(), nil
+}
+
+// Picks the report with the given name, or all of them for "" or "all"
+func findReports(reports []ReportConfig, name string) ([]ReportConfig, error) {
+	if name == "" || name == "all" {
+		return reports, nil
+	}
+	for _, report := range reports {
+		if report.name == name {
+			return []ReportConfig{report}, nil
+		}
+	}
+	names := []string{}
+	for _, report := range reports {
+		names = append(names, report.name)
+	}
+	return nil, fmt.Errorf("No report named '%s'; choices are %s",
+		name, strings.Join(names, ", "))
+}
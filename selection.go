@@ -0,0 +1,98 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Put this in a dashboard's tags or description, or a panel's description,
+// to leave it out of reports
+var SKIP_MARKER_PATTERN = regexp.MustCompile(`(?i)email-report:\s*skip`)
+
+// Which dashboards and panels go into a report; empty lists and nil
+// patterns don't filter anything
+type Selection struct {
+	Dashboards         []string // titles or uids
+	ExcludeDashboards  []string // titles or uids
+	DashboardTags      []string // dashboards with any of these tags
+	Panels             *regexp.Regexp
+	ExcludePanels      *regexp.Regexp
+	ExcludeDataSources []string
+}
+
+func (selection Selection) includesDashboard(dashboard Dashboard) bool {
+	if SKIP_MARKER_PATTERN.MatchString(dashboard.Description) {
+		return false
+	}
+	for _, tag := range dashboard.Tags {
+		if SKIP_MARKER_PATTERN.MatchString(tag) {
+			return false
+		}
+	}
+
+	if len(selection.Dashboards) > 0 &&
+		!containsString(selection.Dashboards, dashboard.Title) &&
+		!containsString(selection.Dashboards, dashboard.Uid) {
+		return false
+	}
+	if containsString(selection.ExcludeDashboards, dashboard.Title) ||
+		(dashboard.Uid != "" && containsString(selection.ExcludeDashboards, dashboard.Uid)) {
+		return false
+	}
+
+	if len(selection.DashboardTags) > 0 {
+		for _, tag := range dashboard.Tags {
+			if containsString(selection.DashboardTags, tag) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (selection Selection) includesPanel(panel Panel) bool {
+	if SKIP_MARKER_PATTERN.MatchString(panel.Description) {
+		return false
+	}
+	if containsString(selection.ExcludeDataSources, string(panel.DataSource)) {
+		return false
+	}
+	if selection.Panels != nil && !selection.Panels.MatchString(panel.Title) {
+		return false
+	}
+	if selection.ExcludePanels != nil && selection.ExcludePanels.MatchString(panel.Title) {
+		return false
+	}
+	return true
+}
+
+func selectDashboards(selection Selection, dashboards []Dashboard) []Dashboard {
+	selected := []Dashboard{}
+	for _, dashboard := range dashboards {
+		if selection.includesDashboard(dashboard) {
+			selected = append(selected, dashboard)
+		}
+	}
+	return selected
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits a comma-separated flag value, dropping blanks
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) != "" {
+			list = append(list, strings.TrimSpace(item))
+		}
+	}
+	return list
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Matches $m, $col, $tag_host, $1 and the same in [[...]] form, as used in
+// InfluxDB targets' alias patterns
+var ALIAS_PATTERN = regexp.MustCompile(`\$(\w+)|\[\[(\w+)\]\]`)
+
+// One line on a chart
+type Series struct {
+	Name        string // shown in the legend
+	Measurement string
+	Column      string
+	Tags        map[string]string
+	Points      []Point
+	Format      string // unit of the values, e.g. bytes; see the units package
+}
+
+func nonNullPoints(points []Point) []Point {
+	nonNull := []Point{}
+	for _, point := range points {
+		if !math.IsNaN(point.Value) {
+			nonNull = append(nonNull, point)
+		}
+	}
+	return nonNull
+}
+
+// Names a series from an InfluxDB query after the target's alias, or if
+// there isn't one like Grafana does, e.g. "cpu.mean {host: a}"
+func influxSeriesName(series Series, alias string) string {
+	if alias == "" {
+		name := series.Measurement + "." + series.Column
+		if len(series.Tags) == 0 {
+			return name
+		}
+		keys := []string{}
+		for key := range series.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := []string{}
+		for _, key := range keys {
+			pairs = append(pairs, key+": "+series.Tags[key])
+		}
+		return name + " {" + strings.Join(pairs, ", ") + "}"
+	}
+
+	return ALIAS_PATTERN.ReplaceAllStringFunc(alias, func(match string) string {
+		groups := ALIAS_PATTERN.FindStringSubmatch(match)
+		name := groups[1] + groups[2]
+
+		switch {
+		case name == "m" || name == "measurement":
+			return series.Measurement
+		case name == "col":
+			return series.Column
+		case strings.HasPrefix(name, "tag_"):
+			return series.Tags[strings.TrimPrefix(name, "tag_")]
+		}
+		// $1 to $9 are the dot-separated parts of the measurement name
+		if index, err := strconv.Atoi(name); err == nil && index >= 1 {
+			parts := strings.Split(series.Measurement, ".")
+			if index <= len(parts) {
+				return parts[index-1]
+			}
+			return ""
+		}
+		return match
+	})
+}
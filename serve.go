@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A run that fires this late still counts as on time, even with no
+// -catchUpWindow
+const ON_TIME_SLACK = time.Minute
+
+// When each report last ran (or was skipped), saved to -stateFile so runs
+// missed while the daemon was down can be caught up after a restart
+type RunState struct {
+	LastRuns map[string]time.Time `json:"lastRuns"`
+
+	path string
+	lock sync.Mutex
+}
+
+func loadRunState(path string) (*RunState, error) {
+	state := &RunState{LastRuns: map[string]time.Time{}, path: path}
+	if path == "" {
+		return state, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, state); err != nil {
+		return nil, err
+	}
+	if state.LastRuns == nil {
+		state.LastRuns = map[string]time.Time{}
+	}
+	return state, nil
+}
+
+func (state *RunState) lastRun(reportName string) time.Time {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return state.LastRuns[reportName]
+}
+
+// Records the run and rewrites the state file, via a rename so a crash
+// can't leave it half-written
+func (state *RunState) recordRun(reportName string, scheduledTime time.Time) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	state.LastRuns[reportName] = scheduledTime
+	if state.path == "" {
+		return
+	}
+
+	contents, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		log.Printf("Error from json.MarshalIndent: %s", err)
+		return
+	}
+	if err := ioutil.WriteFile(state.path+".tmp", contents, 0644); err != nil {
+		log.Printf("Error writing %s.tmp: %s", state.path, err)
+		return
+	}
+	if err := os.Rename(state.path+".tmp", state.path); err != nil {
+		log.Printf("Error from Rename: %s", err)
+	}
+}
+
+// Runs each scheduled report at its times until ctx is cancelled. Only one
+// report runs at a time.
+func serve(ctx context.Context, config Config, dataSources *DataSources) {
+	state, err := loadRunState(config.stateFile)
+	if err != nil {
+		log.Fatalf("Error loading -stateFile %s: %s", config.stateFile, err)
+	}
+	if config.stateFile == "" {
+		log.Printf("No -stateFile, so runs missed before startup won't be caught up")
+	}
+
+	var runLock sync.Mutex
+	var waitGroup sync.WaitGroup
+	for _, report := range config.reports {
+		if report.schedule == nil {
+			log.Printf("Report '%s' has no schedule, so it won't run", report.name)
+			continue
+		}
+
+		waitGroup.Add(1)
+		go func(report ReportConfig) {
+			defer waitGroup.Done()
+			serveReport(ctx, config, report, dataSources, state, &runLock)
+		}(report)
+	}
+	waitGroup.Wait()
+}
+
+func serveReport(ctx context.Context, config Config, report ReportConfig,
+	dataSources *DataSources, state *RunState, runLock *sync.Mutex) {
+
+	last := state.lastRun(report.name)
+	if last.IsZero() {
+		last = time.Now()
+	}
+
+	for {
+		next := report.schedule.Next(last)
+		if next.IsZero() {
+			log.Printf("Report '%s' will never run again", report.name)
+			return
+		}
+		log.Printf("Report '%s' will next run at %s", report.name, next)
+
+		if wait := next.Sub(time.Now()); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		runLock.Lock()
+		if ctx.Err() != nil {
+			runLock.Unlock()
+			return
+		}
+		last = runDueReport(ctx, config, report, dataSources, state, last, time.Now())
+		runLock.Unlock()
+	}
+}
+
+// Runs the latest of the report's runs due between last and now, if it's
+// not too late, and returns its scheduled time. Earlier due runs are skipped rather
+// than run back to back; they can pile up while the daemon is down or while
+// other reports hold up the run lock.
+func runDueReport(ctx context.Context, config Config, report ReportConfig,
+	dataSources *DataSources, state *RunState, last, now time.Time) time.Time {
+
+	due := time.Time{}
+	numDue := 0
+	for t := report.schedule.Next(last); !t.IsZero() && !t.After(now); t = report.schedule.Next(t) {
+		due = t
+		numDue += 1
+	}
+	if numDue == 0 {
+		return last
+	}
+	if numDue > 1 {
+		log.Printf("Skipping %d missed run(s) of report '%s'", numDue-1, report.name)
+	}
+
+	lateness := now.Sub(due)
+	if lateness > ON_TIME_SLACK && lateness > config.catchUpWindow {
+		log.Printf("Skipping run of report '%s' scheduled for %s; it's %s late, beyond -catchUpWindow",
+			report.name, due, lateness)
+		state.recordRun(report.name, due)
+		return due
+	}
+
+	// Reload so the report reflects the live dashboards
+	dashboards, err := loadDashboards(config)
+	if err != nil {
+		log.Printf("Report '%s' scheduled for %s failed: %s", report.name, due, err)
+		state.recordRun(report.name, due)
+		return due
+	}
+
+	start := time.Now()
+	numFailures, err := runReport(ctx, config, report, dashboards, dataSources, due)
+	if err != nil {
+		log.Printf("Report '%s' scheduled for %s failed after %s: %s",
+			report.name, due, time.Since(start), err)
+	} else {
+		log.Printf("Report '%s' scheduled for %s finished in %s with %d failed panel(s)",
+			report.name, due, time.Since(start), numFailures)
+	}
+	state.recordRun(report.name, due)
+	return due
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunDueReport(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	date := func(day, hour, minute int) time.Time {
+		return time.Date(2021, time.June, day, hour, minute, 0, 0, newYork)
+	}
+	schedule, err := parseCronSchedule("0 7 * * *", newYork)
+	if err != nil {
+		t.Fatalf("Error from parseCronSchedule: %s", err)
+	}
+
+	tests := []struct {
+		name          string
+		last          time.Time
+		now           time.Time
+		catchUpWindow time.Duration
+		expectedLast  time.Time
+		expectRun     bool
+	}{
+		{"nothing due", date(1, 7, 0), date(2, 6, 59), time.Hour, date(1, 7, 0), false},
+		{"on time", date(1, 7, 0), date(2, 7, 0), 0, date(2, 7, 0), true},
+		{"within the slack", date(1, 7, 0), date(2, 7, 0).Add(ON_TIME_SLACK), 0,
+			date(2, 7, 0), true},
+		{"late but in the window", date(1, 7, 0), date(2, 7, 45), time.Hour,
+			date(2, 7, 0), true},
+		{"beyond the window", date(1, 7, 0), date(2, 8, 1), time.Hour, date(2, 7, 0), false},
+		// After three days down, only the latest missed run happens
+		{"several missed", date(1, 7, 0), date(4, 7, 30), time.Hour, date(4, 7, 0), true},
+		{"several missed, latest too late", date(1, 7, 0), date(4, 9, 0), time.Hour,
+			date(4, 7, 0), false},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "serve_test")
+		if err != nil {
+			t.Fatalf("Error from TempDir: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// No dashboards, so a run just writes an empty PNG
+		dashboardsPath := filepath.Join(dir, "grafana_config.txt")
+		if err := ioutil.WriteFile(dashboardsPath, []byte{}, 0644); err != nil {
+			t.Fatalf("Error from WriteFile: %s", err)
+		}
+		config := Config{
+			grafanaConfigPath: dashboardsPath,
+			catchUpWindow:     test.catchUpWindow,
+			concurrency:       1,
+			tableMaxRows:      DEFAULT_TABLE_MAX_ROWS,
+		}
+		report := ReportConfig{
+			name:     "daily",
+			pngPath:  filepath.Join(dir, "daily.png"),
+			from:     "now-1d",
+			to:       "now",
+			schedule: schedule,
+		}
+		state, err := loadRunState(filepath.Join(dir, "state.json"))
+		if err != nil {
+			t.Fatalf("Error from loadRunState: %s", err)
+		}
+
+		actual := runDueReport(context.Background(), config, report, nil, state,
+			test.last, test.now)
+		if !actual.Equal(test.expectedLast) {
+			t.Errorf("%s: expected to return %s but got %s", test.name, test.expectedLast, actual)
+		}
+		_, err = os.Stat(report.pngPath)
+		if ran := err == nil; ran != test.expectRun {
+			t.Errorf("%s: expected ran=%v but got %v", test.name, test.expectRun, ran)
+		}
+
+		// Skipped runs are recorded too, so a restart doesn't retry them
+		reloaded, err := loadRunState(filepath.Join(dir, "state.json"))
+		if err != nil {
+			t.Fatalf("Error from loadRunState: %s", err)
+		}
+		expectedRecorded := test.expectedLast
+		if test.expectedLast.Equal(test.last) {
+			expectedRecorded = time.Time{}
+		}
+		if recorded := reloaded.lastRun("daily"); !recorded.Equal(expectedRecorded) {
+			t.Errorf("%s: expected %s in the state file but got %s",
+				test.name, expectedRecorded, recorded)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielstutzman/email-grafana-reports/units"
+	chart "github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
+)
+
+// Grafana's defaults for singlestat panels
+const DEFAULT_STAT_VALUE_NAME = "avg"
+const DEFAULT_STAT_NULL_TEXT = "N/A"
+
+var DEFAULT_STAT_COLORS = []string{"#299c46", "rgba(237, 129, 40, 0.89)", "#d44a3a"}
+var DEFAULT_SPARKLINE_LINE_COLOR = "rgb(31, 120, 193)"
+var DEFAULT_SPARKLINE_FILL_COLOR = "rgba(31, 118, 189, 0.18)"
+
+// The value is drawn as large as fits, up to this size
+const STAT_MAX_FONT_SIZE = 40.0
+const STAT_MIN_FONT_SIZE = 8.0
+
+// A stat panel shows one value per series, up to this many
+const STAT_MAX_VALUES = 4
+
+// How a singlestat or stat panel shows its value
+type StatOptions struct {
+	reducer         string // e.g. current or lastNotNull
+	prefix          string
+	postfix         string
+	format          string
+	decimals        int // < 0 to suit the value
+	thresholds      []float64
+	colors          []drawing.Color // one more than thresholds
+	colorValue      bool
+	colorBackground bool
+	mappings        []StatMapping
+	sparkline       bool
+	sparklineFull   bool
+	lineColor       drawing.Color
+	fillColor       drawing.Color
+}
+
+// Text to show in place of a value, a range of values or no value at all
+type StatMapping struct {
+	null   bool
+	ranged bool
+	value  float64
+	from   float64
+	to     float64
+	text   string
+}
+
+// Reads the options of a Grafana 7+ stat panel or an older singlestat one
+func panelStatOptions(panel Panel) (StatOptions, error) {
+	if panel.Type == "stat" {
+		return statPanelOptions(panel)
+	}
+
+	options := StatOptions{
+		reducer:         panel.ValueName,
+		prefix:          panel.Prefix,
+		postfix:         panel.Postfix,
+		format:          panel.Format,
+		colorValue:      panel.ColorValue,
+		colorBackground: panel.ColorBackground,
+		sparkline:       panel.Sparkline.Show,
+		sparklineFull:   panel.Sparkline.Full,
+	}
+	if options.reducer == "" {
+		options.reducer = DEFAULT_STAT_VALUE_NAME
+	}
+
+	var err error
+	if options.decimals, err = parseDecimals(panel.Decimals); err != nil {
+		return options, err
+	}
+
+	var thresholds string
+	if len(panel.Thresholds) > 0 && json.Unmarshal(panel.Thresholds, &thresholds) == nil {
+		for _, threshold := range splitList(thresholds) {
+			value, err := strconv.ParseFloat(threshold, 64)
+			if err != nil {
+				return options, fmt.Errorf("Bad threshold '%s'", threshold)
+			}
+			options.thresholds = append(options.thresholds, value)
+		}
+	}
+
+	colors := panel.Colors
+	if len(colors) == 0 {
+		colors = DEFAULT_STAT_COLORS
+	}
+	for _, color := range colors {
+		parsed, err := parseColor(color)
+		if err != nil {
+			return options, err
+		}
+		options.colors = append(options.colors, parsed)
+	}
+
+	if panel.MappingType == 2 {
+		for _, rangeMap := range panel.RangeMaps {
+			options.mappings = append(options.mappings, StatMapping{
+				ranged: true,
+				from:   parseLimit(rangeMap.From, math.Inf(-1)),
+				to:     parseLimit(rangeMap.To, math.Inf(1)),
+				text:   rangeMap.Text,
+			})
+		}
+	} else {
+		for _, valueMap := range panel.ValueMaps {
+			if valueMap.Value == "null" {
+				options.mappings = append(options.mappings,
+					StatMapping{null: true, text: valueMap.Text})
+			} else if value, err := strconv.ParseFloat(string(valueMap.Value), 64); err == nil {
+				options.mappings = append(options.mappings,
+					StatMapping{value: value, text: valueMap.Text})
+			}
+		}
+	}
+
+	lineColor := panel.Sparkline.LineColor
+	if lineColor == "" {
+		lineColor = DEFAULT_SPARKLINE_LINE_COLOR
+	}
+	if options.lineColor, err = parseColor(lineColor); err != nil {
+		return options, err
+	}
+	fillColor := panel.Sparkline.FillColor
+	if fillColor == "" {
+		fillColor = DEFAULT_SPARKLINE_FILL_COLOR
+	}
+	if options.fillColor, err = parseColor(fillColor); err != nil {
+		return options, err
+	}
+	return options, nil
+}
+
+func statPanelOptions(panel Panel) (StatOptions, error) {
+	defaults := panel.FieldConfig.Defaults
+	options := StatOptions{
+		reducer:         "lastNotNull",
+		format:          defaults.Unit,
+		colorValue:      panel.Options.ColorMode == "" || panel.Options.ColorMode == "value",
+		colorBackground: panel.Options.ColorMode == "background",
+		sparkline:       panel.Options.GraphMode != "none",
+		mappings:        parseFieldMappings(defaults.Mappings),
+	}
+	if len(panel.Options.ReduceOptions.Calcs) > 0 {
+		options.reducer = panel.Options.ReduceOptions.Calcs[0]
+	}
+
+	var err error
+	if options.decimals, err = parseDecimals(defaults.Decimals); err != nil {
+		return options, err
+	}
+
+	// Steps are in order, the first with no value being the base color
+	for _, step := range defaults.Thresholds.Steps {
+		color, err := parseColor(step.Color)
+		if err != nil {
+			return options, err
+		}
+		if step.Value != nil && len(options.colors) > 0 {
+			options.thresholds = append(options.thresholds, *step.Value)
+		}
+		options.colors = append(options.colors, color)
+	}
+
+	options.lineColor, _ = parseColor(DEFAULT_SPARKLINE_LINE_COLOR)
+	if len(options.colors) > 0 {
+		options.lineColor = options.colors[0]
+	}
+	options.fillColor = options.lineColor.WithAlpha(46)
+	return options, nil
+}
+
+func parseDecimals(decimals NumberString) (int, error) {
+	if decimals == "" {
+		return -1, nil
+	}
+	value, err := strconv.Atoi(string(decimals))
+	if err != nil {
+		return -1, fmt.Errorf("Bad decimals '%s'", decimals)
+	}
+	return value, nil
+}
+
+// For the ends of range mappings, which may be left blank
+func parseLimit(limit NumberString, unset float64) float64 {
+	value, err := strconv.ParseFloat(string(limit), 64)
+	if err != nil {
+		return unset
+	}
+	return value
+}
+
+// Reads value mappings as Grafana 7 saves them, like
+// {"type": 1, "value": "0", "text": "Down"}, or as Grafana 8+ does, like
+// {"type": "value", "options": {"0": {"text": "Down"}}}. Skips any it
+// doesn't understand.
+func parseFieldMappings(raws []json.RawMessage) []StatMapping {
+	mappings := []StatMapping{}
+	for _, raw := range raws {
+		var mapping struct {
+			Type    json.RawMessage `json:"type"`
+			Value   NumberString    `json:"value"`
+			From    NumberString    `json:"from"`
+			To      NumberString    `json:"to"`
+			Text    string          `json:"text"`
+			Options json.RawMessage `json:"options"`
+		}
+		if json.Unmarshal(raw, &mapping) != nil {
+			continue
+		}
+
+		var oldType int
+		var newType string
+		if json.Unmarshal(mapping.Type, &oldType) == nil {
+			if oldType == 1 && mapping.Value == "null" {
+				mappings = append(mappings, StatMapping{null: true, text: mapping.Text})
+			} else if oldType == 1 {
+				if value, err := strconv.ParseFloat(string(mapping.Value), 64); err == nil {
+					mappings = append(mappings, StatMapping{value: value, text: mapping.Text})
+				}
+			} else if oldType == 2 {
+				mappings = append(mappings, StatMapping{
+					ranged: true,
+					from:   parseLimit(mapping.From, math.Inf(-1)),
+					to:     parseLimit(mapping.To, math.Inf(1)),
+					text:   mapping.Text,
+				})
+			}
+			continue
+		}
+		if json.Unmarshal(mapping.Type, &newType) != nil {
+			continue
+		}
+
+		type result struct {
+			Text string `json:"text"`
+		}
+		switch newType {
+		case "value":
+			var values map[string]result
+			if json.Unmarshal(mapping.Options, &values) != nil {
+				continue
+			}
+			for key, result := range values {
+				if value, err := strconv.ParseFloat(key, 64); err == nil {
+					mappings = append(mappings, StatMapping{value: value, text: result.Text})
+				}
+			}
+		case "range":
+			var options struct {
+				From   *float64 `json:"from"`
+				To     *float64 `json:"to"`
+				Result result   `json:"result"`
+			}
+			if json.Unmarshal(mapping.Options, &options) != nil {
+				continue
+			}
+			statMapping := StatMapping{
+				ranged: true,
+				from:   math.Inf(-1),
+				to:     math.Inf(1),
+				text:   options.Result.Text,
+			}
+			if options.From != nil {
+				statMapping.from = *options.From
+			}
+			if options.To != nil {
+				statMapping.to = *options.To
+			}
+			mappings = append(mappings, statMapping)
+		case "special":
+			var options struct {
+				Match  string `json:"match"`
+				Result result `json:"result"`
+			}
+			if json.Unmarshal(mapping.Options, &options) == nil &&
+				strings.Contains(options.Match, "null") {
+				mappings = append(mappings, StatMapping{null: true, text: options.Result.Text})
+			}
+		}
+	}
+	return mappings
+}
+
+// Boils a series down to one value, the way Grafana's singlestat valueName
+// or stat calcs say to; ok is false if there are no points to do it with
+func reducePoints(points []Point, reducer string) (value float64, ok bool, err error) {
+	points = nonNullPoints(points)
+	if len(points) == 0 {
+		return 0, false, nil
+	}
+
+	switch reducer {
+	case "current", "last", "lastNotNull":
+		return points[len(points)-1].Value, true, nil
+	case "first", "firstNotNull":
+		return points[0].Value, true, nil
+	case "avg", "mean", "total", "sum":
+		sum := 0.0
+		for _, point := range points {
+			sum += point.Value
+		}
+		if reducer == "avg" || reducer == "mean" {
+			return sum / float64(len(points)), true, nil
+		}
+		return sum, true, nil
+	case "min", "max", "range":
+		_, min, max := seriesStats(points)
+		if reducer == "min" {
+			return min, true, nil
+		} else if reducer == "max" {
+			return max, true, nil
+		}
+		return max - min, true, nil
+	case "count":
+		return float64(len(points)), true, nil
+	case "diff":
+		return points[len(points)-1].Value - points[0].Value, true, nil
+	case "delta":
+		// Like a counter's increase, so a reset to 0 doesn't count as a drop
+		delta := 0.0
+		for i := 1; i < len(points); i++ {
+			if points[i].Value >= points[i-1].Value {
+				delta += points[i].Value - points[i-1].Value
+			} else {
+				delta += points[i].Value
+			}
+		}
+		return delta, true, nil
+	default:
+		return 0, false, fmt.Errorf("Unsupported value '%s' for stat panel", reducer)
+	}
+}
+
+// What the panel shows for a value: mapped text, or the formatted number
+func (options StatOptions) text(value float64, ok bool) string {
+	for _, mapping := range options.mappings {
+		if (mapping.null && !ok) ||
+			(ok && !mapping.null && !mapping.ranged && mapping.value == value) ||
+			(ok && mapping.ranged && value >= mapping.from && value <= mapping.to) {
+			return mapping.text
+		}
+	}
+	if !ok {
+		return DEFAULT_STAT_NULL_TEXT
+	}
+	return options.prefix + units.Format(value, options.format, options.decimals) + options.postfix
+}
+
+func (options StatOptions) color(value float64) drawing.Color {
+	if len(options.colors) == 0 {
+		return chart.ColorBlack
+	}
+	return thresholdColor(value, options.thresholds, options.colors)
+}
+
+// The color for the range of thresholds the value is in, from colors which
+// has one more than thresholds
+func thresholdColor(value float64, thresholds []float64, colors []drawing.Color) drawing.Color {
+	i := 0
+	for j, threshold := range thresholds {
+		if value >= threshold {
+			i = j + 1
+		}
+	}
+	if i >= len(colors) {
+		i = len(colors) - 1
+	}
+	return colors[i]
+}
+
+// Draws a singlestat or stat panel as a tile with its value in large text.
+// Singlestat panels show the first series, like Grafana; stat panels show
+// one value per series.
+func drawStat(allSeries []Series, panel Panel, xMin, xMax time.Time) (image.Image, error) {
+	options, err := panelStatOptions(panel)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(allSeries) == 0 {
+		allSeries = []Series{{}} // shows the text for no value
+	}
+	numValues := 1
+	if panel.Type == "stat" {
+		numValues = int(math.Min(float64(len(allSeries)), STAT_MAX_VALUES))
+	}
+
+	renderer, font, err := newTile(panel.Title, CHART_HEIGHT, chart.ColorLightGray)
+	if err != nil {
+		return nil, err
+	}
+
+	cellTop := TILE_TITLE_HEIGHT
+	cellHeight := (CHART_HEIGHT - 10 - cellTop) / numValues
+	for i := 0; i < numValues; i++ {
+		series := allSeries[i]
+		value, ok, text := 0.0, false, series.Name
+		if options.reducer == "name" { // singlestat can show the name instead
+			if text == "" {
+				text = DEFAULT_STAT_NULL_TEXT
+			}
+		} else {
+			value, ok, err = reducePoints(series.Points, options.reducer)
+			if err != nil {
+				return nil, err
+			}
+			text = options.text(value, ok)
+		}
+		// A transparent threshold color leaves the value uncolored
+		color := options.color(value)
+		colored := ok && color.A > 0
+
+		cell := chart.Box{
+			Top:    cellTop + i*cellHeight,
+			Left:   10,
+			Right:  CHART_WIDTH - 10,
+			Bottom: cellTop + (i+1)*cellHeight,
+		}
+		textColor := chart.ColorBlack
+		lineColor := options.lineColor
+		fillColor := options.fillColor
+		if colored && options.colorBackground {
+			chart.Draw.Box(renderer, cell, chart.Style{
+				FillColor:   color,
+				StrokeColor: color,
+				StrokeWidth: 1,
+			})
+			textColor = drawing.ColorWhite
+			lineColor = drawing.ColorWhite.WithAlpha(128)
+			fillColor = drawing.ColorWhite.WithAlpha(46)
+		} else if colored && options.colorValue {
+			textColor = color
+			if panel.Type == "stat" {
+				lineColor = textColor
+				fillColor = textColor.WithAlpha(46)
+			}
+		}
+
+		if options.sparkline {
+			sparklineBox := cell
+			if !options.sparklineFull {
+				sparklineBox.Top = cell.Bottom - cell.Height()*2/5
+			}
+			drawSparkline(renderer, series.Points, sparklineBox, xMin, xMax,
+				lineColor, fillColor)
+		}
+
+		valueBox := cell
+		if numValues > 1 {
+			drawWrappedText(renderer, series.Name,
+				chart.Box{Top: cell.Top, Left: cell.Left, Right: cell.Right, Bottom: cell.Top + 15},
+				chart.Style{
+					Font:      font,
+					FontSize:  LEGEND_FONT_SIZE,
+					FontColor: textColor,
+					TextWrap:  chart.TextWrapNone,
+				})
+			valueBox.Top += 15
+		}
+		drawFittedText(renderer, text, valueBox, chart.Style{
+			Font:      font,
+			FontColor: textColor,
+		})
+	}
+
+	return finishTile(renderer)
+}
+
+// Draws one line of text centered in box, as large as fits
+func drawFittedText(renderer chart.Renderer, text string, box chart.Box, style chart.Style) {
+	for style.FontSize = STAT_MAX_FONT_SIZE; style.FontSize > STAT_MIN_FONT_SIZE; style.FontSize -= 2 {
+		style.WriteTextOptionsToRenderer(renderer)
+		size := renderer.MeasureText(text)
+		if size.Width() <= box.Width() && size.Height() <= box.Height() {
+			break
+		}
+	}
+	style.WriteTextOptionsToRenderer(renderer)
+	defer renderer.ResetStyle()
+
+	size := renderer.MeasureText(text)
+	x := box.Left + (box.Width()-size.Width())/2
+	y := box.Top + (box.Height()+size.Height())/2
+	renderer.Text(text, x, y)
+}
+
+// Draws the series' shape across box, scaled to fit it
+func drawSparkline(renderer chart.Renderer, points []Point, box chart.Box,
+	xMin, xMax time.Time, lineColor, fillColor drawing.Color) {
+
+	points = nonNullPoints(points)
+	if len(points) < 2 || !xMax.After(xMin) {
+		return
+	}
+	_, min, max := seriesStats(points)
+
+	xs := make([]int, len(points))
+	ys := make([]int, len(points))
+	for i, point := range points {
+		xs[i] = box.Left + int(float64(box.Width())*
+			float64(point.Time.Sub(xMin))/float64(xMax.Sub(xMin)))
+		ys[i] = box.Top + box.Height()/2
+		if max > min {
+			ys[i] = box.Bottom - int(float64(box.Height())*(point.Value-min)/(max-min))
+		}
+	}
+
+	renderer.SetFillColor(fillColor)
+	renderer.SetStrokeWidth(0)
+	renderer.MoveTo(xs[0], box.Bottom)
+	for i := range xs {
+		renderer.LineTo(xs[i], ys[i])
+	}
+	renderer.LineTo(xs[len(xs)-1], box.Bottom)
+	renderer.Close()
+	renderer.Fill()
+
+	renderer.SetStrokeColor(lineColor)
+	renderer.SetStrokeWidth(1)
+	renderer.MoveTo(xs[0], ys[0])
+	for i := 1; i < len(xs); i++ {
+		renderer.LineTo(xs[i], ys[i])
+	}
+	renderer.Stroke()
+	renderer.ResetStyle()
+}
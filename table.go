@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielstutzman/email-grafana-reports/units"
+	chart "github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
+)
+
+// Longer tables are cut short so the email stays a reasonable size, unless
+// -tableMaxRows or a report's tableMaxRows says otherwise
+const DEFAULT_TABLE_MAX_ROWS = 20
+
+const TABLE_ROW_HEIGHT = 16
+const TABLE_FONT_SIZE = 8.0
+const TABLE_CELL_PADDING = 4
+
+const DEFAULT_TABLE_DATE_FORMAT = "YYYY-MM-DD HH:mm:ss"
+
+// Converts the Moment.js date tokens Grafana uses to Go's layout; longer
+// tokens come first so MMMM isn't taken for MM MM
+var MOMENT_TOKENS = strings.NewReplacer(
+	"YYYY", "2006", "YY", "06",
+	"MMMM", "January", "MMM", "Jan", "MM", "01", "M", "1",
+	"dddd", "Monday", "ddd", "Mon",
+	"DD", "02", "D", "2",
+	"HH", "15", "H", "15", "hh", "03", "h", "3",
+	"mm", "04", "m", "4",
+	"ss", "05", "s", "5",
+	"SSS", "000",
+	"A", "PM", "a", "pm",
+	"ZZ", "-0700", "Z", "-07:00",
+)
+
+// A table panel's contents, formatted for display
+type Table struct {
+	Headers  []string
+	Rows     [][]TableCell
+	MoreRows int // left out beyond the report's tableMaxRows
+}
+
+type TableCell struct {
+	Text       string
+	Color      drawing.Color // zero for the default
+	Background drawing.Color // zero for none
+}
+
+// A table before styling; each value is a time.Time, a float64 (NaN for
+// null) or a string
+type rawTable struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+// A column style with its pattern compiled
+type compiledStyle struct {
+	ColumnStyle
+	pattern    *regexp.Regexp // nil to match the name exactly
+	decimals   int
+	thresholds []float64
+	colors     []drawing.Color
+}
+
+// Turns the panel's series into a table the way its transform says to, then
+// sorts, styles and cuts it down to maxRows
+func buildTable(allSeries []Series, panel Panel, maxRows int) (*Table, error) {
+	raw, err := transformSeries(allSeries, panel)
+	if err != nil {
+		return nil, err
+	}
+	if panel.Sort.Col != nil && *panel.Sort.Col >= 0 && *panel.Sort.Col < len(raw.columns) {
+		sortRows(raw.rows, *panel.Sort.Col, panel.Sort.Desc)
+	}
+
+	styles, err := compileStyles(panel.Styles)
+	if err != nil {
+		return nil, err
+	}
+	columnStyles := make([]*compiledStyle, len(raw.columns))
+	for i, column := range raw.columns {
+		columnStyles[i] = findStyle(styles, column)
+	}
+
+	table := &Table{}
+	for i, column := range raw.columns {
+		style := columnStyles[i]
+		if style != nil && style.Type == "hidden" {
+			continue
+		}
+		if style != nil && style.Alias != "" {
+			column = style.Alias
+		}
+		table.Headers = append(table.Headers, column)
+	}
+
+	rows := raw.rows
+	if len(rows) > maxRows {
+		table.MoreRows = len(rows) - maxRows
+		rows = rows[:maxRows]
+	}
+	for _, rawRow := range rows {
+		row := []TableCell{}
+		rowBackground := drawing.Color{}
+		for i, value := range rawRow {
+			style := columnStyles[i]
+			if style != nil && style.Type == "hidden" {
+				continue
+			}
+			cell := formatCell(value, style)
+			if style != nil && style.ColorMode == "row" && !cell.Background.IsZero() {
+				rowBackground = cell.Background
+				cell.Background = drawing.Color{}
+			}
+			row = append(row, cell)
+		}
+		if !rowBackground.IsZero() {
+			for i := range row {
+				row[i].Background = rowBackground
+				row[i].Color = drawing.ColorWhite
+			}
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table, nil
+}
+
+func transformSeries(allSeries []Series, panel Panel) (rawTable, error) {
+	switch panel.Transform {
+	case "", "timeseries_to_columns":
+		return seriesToColumns(allSeries), nil
+	case "timeseries_to_rows":
+		table := rawTable{columns: []string{"Time", "Metric", "Value"}}
+		for _, series := range allSeries {
+			for _, point := range series.Points {
+				table.rows = append(table.rows,
+					[]interface{}{point.Time, series.Name, point.Value})
+			}
+		}
+		return table, nil
+	case "timeseries_aggregations":
+		columns := panel.Columns
+		if len(columns) == 0 {
+			columns = []TableColumn{{Text: "Avg", Value: "avg"}}
+		}
+		table := rawTable{columns: []string{"Metric"}}
+		for _, column := range columns {
+			table.columns = append(table.columns, column.Text)
+		}
+		for _, series := range allSeries {
+			row := []interface{}{series.Name}
+			for _, column := range columns {
+				value, ok, err := reducePoints(series.Points, column.Value)
+				if err != nil {
+					return rawTable{}, err
+				}
+				if !ok {
+					value = math.NaN()
+				}
+				row = append(row, value)
+			}
+			table.rows = append(table.rows, row)
+		}
+		return table, nil
+	case "table":
+		return seriesToTable(allSeries), nil
+	default:
+		return rawTable{}, fmt.Errorf("Unsupported table transform '%s'", panel.Transform)
+	}
+}
+
+// A Time column and one column per series, with a row per timestamp
+func seriesToColumns(allSeries []Series) rawTable {
+	table := rawTable{columns: []string{"Time"}}
+	rowsByTime := map[int64][]interface{}{}
+	times := []time.Time{}
+	for i, series := range allSeries {
+		table.columns = append(table.columns, series.Name)
+		for _, point := range series.Points {
+			key := point.Time.UnixNano()
+			if rowsByTime[key] == nil {
+				row := []interface{}{point.Time}
+				for range allSeries {
+					row = append(row, math.NaN())
+				}
+				rowsByTime[key] = row
+				times = append(times, point.Time)
+			}
+			rowsByTime[key][i+1] = point.Value
+		}
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	for _, t := range times {
+		table.rows = append(table.rows, rowsByTime[t.UnixNano()])
+	}
+	return table
+}
+
+// The query's own columns, as InfluxDB returns them: Time, then any tags
+// grouped by, then the selected fields
+func seriesToTable(allSeries []Series) rawTable {
+	tagKeys := []string{}
+	fields := []string{}
+	for _, series := range allSeries {
+		for key := range series.Tags {
+			if !containsString(tagKeys, key) {
+				tagKeys = append(tagKeys, key)
+			}
+		}
+		if !containsString(fields, series.Column) {
+			fields = append(fields, series.Column)
+		}
+	}
+	sort.Strings(tagKeys)
+
+	table := rawTable{columns: append(append([]string{"Time"}, tagKeys...), fields...)}
+	rowsByKey := map[string][]interface{}{}
+	keys := []string{}
+	for _, series := range allSeries {
+		tagValues := []string{}
+		for _, key := range tagKeys {
+			tagValues = append(tagValues, series.Tags[key])
+		}
+		column := 1 + len(tagKeys)
+		for i, field := range fields {
+			if field == series.Column {
+				column += i
+			}
+		}
+
+		for _, point := range series.Points {
+			key := strings.Join(tagValues, "\x00") + "\x00" +
+				strconv.FormatInt(point.Time.UnixNano(), 10)
+			if rowsByKey[key] == nil {
+				row := []interface{}{point.Time}
+				for _, value := range tagValues {
+					row = append(row, value)
+				}
+				for range fields {
+					row = append(row, math.NaN())
+				}
+				rowsByKey[key] = row
+				keys = append(keys, key)
+			}
+			rowsByKey[key][column] = point.Value
+		}
+	}
+
+	for _, key := range keys {
+		table.rows = append(table.rows, rowsByKey[key])
+	}
+	return table
+}
+
+// Sorts by one column, with nulls last either way
+func sortRows(rows [][]interface{}, column int, desc bool) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i][column], rows[j][column]
+		if isNullCell(a) || isNullCell(b) {
+			return !isNullCell(a) && isNullCell(b)
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch a := a.(type) {
+		case float64:
+			return a < b.(float64)
+		case time.Time:
+			return a.Before(b.(time.Time))
+		default:
+			return fmt.Sprint(a) < fmt.Sprint(b)
+		}
+	})
+}
+
+func isNullCell(value interface{}) bool {
+	number, ok := value.(float64)
+	return ok && math.IsNaN(number)
+}
+
+func compileStyles(styles []ColumnStyle) ([]compiledStyle, error) {
+	compiled := []compiledStyle{}
+	for _, style := range styles {
+		c := compiledStyle{ColumnStyle: style}
+		if strings.HasPrefix(style.Pattern, "/") {
+			var err error
+			if c.pattern, err = compileSlashedRegex(style.Pattern); err != nil {
+				return nil, fmt.Errorf("Bad column style pattern: %s", err)
+			}
+		}
+
+		var err error
+		if c.decimals, err = parseDecimals(style.Decimals); err != nil {
+			return nil, err
+		}
+		for _, threshold := range style.Thresholds {
+			value, err := strconv.ParseFloat(strings.TrimSpace(string(threshold)), 64)
+			if err != nil {
+				return nil, fmt.Errorf("Bad threshold '%s' in column style", threshold)
+			}
+			c.thresholds = append(c.thresholds, value)
+		}
+		for _, color := range style.Colors {
+			parsed, err := parseColor(color)
+			if err != nil {
+				return nil, err
+			}
+			c.colors = append(c.colors, parsed)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// The first style matching the column, like Grafana, or nil
+func findStyle(styles []compiledStyle, column string) *compiledStyle {
+	for i := range styles {
+		if (styles[i].pattern != nil && styles[i].pattern.MatchString(column)) ||
+			(styles[i].pattern == nil && styles[i].Pattern == column) {
+			return &styles[i]
+		}
+	}
+	return nil
+}
+
+func formatCell(value interface{}, style *compiledStyle) TableCell {
+	if style == nil {
+		style = &compiledStyle{decimals: -1}
+	}
+
+	if number, ok := value.(float64); ok && style.Type == "date" && !math.IsNaN(number) {
+		value = time.Unix(0, int64(number)*int64(time.Millisecond)) // epoch ms
+	}
+
+	cell := TableCell{}
+	switch value := value.(type) {
+	case time.Time:
+		dateFormat := style.DateFormat
+		if dateFormat == "" {
+			dateFormat = DEFAULT_TABLE_DATE_FORMAT
+		}
+		cell.Text = formatMomentDate(value.Local(), dateFormat)
+	case float64:
+		if math.IsNaN(value) {
+			break
+		}
+		if style.Type == "string" {
+			cell.Text = units.Format(value, "", -1)
+		} else {
+			cell.Text = units.Format(value, style.Unit, style.decimals)
+		}
+		if style.ColorMode != "" && len(style.colors) > 0 {
+			color := thresholdColor(value, style.thresholds, style.colors)
+			if style.ColorMode == "value" {
+				cell.Color = color
+			} else {
+				cell.Background = color
+				cell.Color = drawing.ColorWhite
+			}
+		}
+	default:
+		cell.Text = fmt.Sprint(value)
+	}
+	return cell
+}
+
+// Formats t with a Moment.js format; text in [brackets] is copied as is,
+// not converted or handed to time.Format, which would treat 1, 2 etc. as
+// layout
+func formatMomentDate(t time.Time, format string) string {
+	var text bytes.Buffer
+	for format != "" {
+		start := strings.Index(format, "[")
+		end := -1
+		if start != -1 {
+			end = strings.Index(format[start:], "]")
+		}
+		if end == -1 {
+			text.WriteString(t.Format(MOMENT_TOKENS.Replace(format)))
+			break
+		}
+		end += start
+		if start > 0 {
+			text.WriteString(t.Format(MOMENT_TOKENS.Replace(format[:start])))
+		}
+		text.WriteString(format[start+1 : end])
+		format = format[end+1:]
+	}
+	return text.String()
+}
+
+// Draws the table as an image, as wide as a chart and as tall as it needs
+func drawTable(table *Table, title string) (image.Image, error) {
+	numLines := 1 + len(table.Rows)
+	if len(table.Rows) == 0 || table.MoreRows > 0 {
+		numLines += 1
+	}
+	height := TILE_TITLE_HEIGHT + numLines*TABLE_ROW_HEIGHT + 10
+
+	renderer, font, err := newTile(title, height, chart.ColorLightGray)
+	if err != nil {
+		return nil, err
+	}
+
+	textStyle := chart.Style{
+		Font:      font,
+		FontSize:  TABLE_FONT_SIZE,
+		FontColor: chart.DefaultTextColor,
+	}
+	textStyle.WriteTextOptionsToRenderer(renderer)
+	widths := tableColumnWidths(renderer, table, CHART_WIDTH-20)
+
+	headerCells := []TableCell{}
+	for _, header := range table.Headers {
+		headerCells = append(headerCells, TableCell{
+			Text:       header,
+			Background: drawing.ColorFromHex("eeeeee"),
+		})
+	}
+	top := TILE_TITLE_HEIGHT
+	drawTableRow(renderer, headerCells, widths, top, textStyle)
+	for _, row := range table.Rows {
+		top += TABLE_ROW_HEIGHT
+		drawTableRow(renderer, row, widths, top, textStyle)
+	}
+
+	note := ""
+	if len(table.Rows) == 0 {
+		note = "no rows"
+	} else if table.MoreRows > 0 {
+		note = fmt.Sprintf("and %d more rows", table.MoreRows)
+	}
+	if note != "" {
+		top += TABLE_ROW_HEIGHT
+		textStyle.FontColor = chart.ColorLightGray
+		textStyle.WriteTextOptionsToRenderer(renderer)
+		renderer.Text(note, 10+TABLE_CELL_PADDING, top+TABLE_ROW_HEIGHT-TABLE_CELL_PADDING)
+	}
+
+	return finishTile(renderer)
+}
+
+// Sizes columns to their widest text, shrunk in proportion if they don't
+// all fit in width
+func tableColumnWidths(renderer chart.Renderer, table *Table, width int) []int {
+	widths := make([]int, len(table.Headers))
+	measure := func(column int, text string) {
+		textWidth := renderer.MeasureText(text).Width() + 2*TABLE_CELL_PADDING
+		if column < len(widths) && textWidth > widths[column] {
+			widths[column] = textWidth
+		}
+	}
+	for i, header := range table.Headers {
+		measure(i, header)
+	}
+	for _, row := range table.Rows {
+		for i, cell := range row {
+			measure(i, cell.Text)
+		}
+	}
+
+	total := 0
+	for _, columnWidth := range widths {
+		total += columnWidth
+	}
+	if total > width {
+		for i := range widths {
+			widths[i] = widths[i] * width / total
+		}
+	}
+	return widths
+}
+
+func drawTableRow(renderer chart.Renderer, cells []TableCell, widths []int, top int,
+	style chart.Style) {
+
+	left := 10
+	for i, cell := range cells {
+		if i >= len(widths) {
+			break
+		}
+		box := chart.Box{Top: top, Left: left, Right: left + widths[i], Bottom: top + TABLE_ROW_HEIGHT}
+		if !cell.Background.IsZero() {
+			chart.Draw.Box(renderer, box, chart.Style{
+				FillColor:   cell.Background,
+				StrokeColor: cell.Background,
+				StrokeWidth: 1,
+			})
+		}
+
+		cellStyle := style
+		if !cell.Color.IsZero() {
+			cellStyle.FontColor = cell.Color
+		}
+		cellStyle.WriteTextOptionsToRenderer(renderer)
+		text := truncateToWidth(renderer, cell.Text, widths[i]-2*TABLE_CELL_PADDING)
+		renderer.Text(text, left+TABLE_CELL_PADDING, top+TABLE_ROW_HEIGHT-TABLE_CELL_PADDING)
+		left += widths[i]
+	}
+
+	renderer.SetStrokeColor(drawing.ColorFromHex("dddddd"))
+	renderer.SetStrokeWidth(1)
+	renderer.MoveTo(10, top+TABLE_ROW_HEIGHT)
+	renderer.LineTo(CHART_WIDTH-10, top+TABLE_ROW_HEIGHT)
+	renderer.Stroke()
+}
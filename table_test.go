@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatMomentDate(t *testing.T) {
+	date := time.Date(2020, time.September, 13, 14, 5, 9, 0, time.UTC)
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{DEFAULT_TABLE_DATE_FORMAT, "2020-09-13 14:05:09"},
+		{"MMM D, h:mm a", "Sep 13, 2:05 pm"},
+		{"dddd [at] HH:mm", "Sunday at 14:05"},
+		{"[Day] D [of] MMMM", "Day 13 of September"},
+		{"YYYY [Q1 2 s m h]", "2020 Q1 2 s m h"},
+		{"[]YY", "20"},
+		{"h [a] a", "2 a pm"},
+	}
+	for _, test := range tests {
+		if actual := formatMomentDate(date, test.format); actual != test.expected {
+			t.Errorf("formatMomentDate(%q) = %q, expected %q", test.format, actual, test.expected)
+		}
+	}
+}
+
+func TestBuildTableMaxRows(t *testing.T) {
+	series := Series{Name: "web-1"}
+	for i := 0; i < 5; i++ {
+		series.Points = append(series.Points, Point{Time: time.Unix(int64(i*60), 0), Value: float64(i)})
+	}
+	panel := Panel{Transform: "timeseries_to_rows"}
+
+	table, err := buildTable([]Series{series}, panel, 3)
+	if err != nil {
+		t.Fatalf("Error from buildTable: %s", err)
+	}
+	if len(table.Rows) != 3 || table.MoreRows != 2 {
+		t.Errorf("Expected 3 rows and 2 more but got %d and %d", len(table.Rows), table.MoreRows)
+	}
+
+	table, err = buildTable([]Series{series}, panel, DEFAULT_TABLE_MAX_ROWS)
+	if err != nil {
+		t.Fatalf("Error from buildTable: %s", err)
+	}
+	if len(table.Rows) != 5 || table.MoreRows != 0 {
+		t.Errorf("Expected 5 rows and none more but got %d and %d", len(table.Rows), table.MoreRows)
+	}
+}
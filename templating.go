@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// What Grafana saves as the current value when "All" is selected
+const ALL_VALUE = "$__all"
+
+// Grafana's defaults for interval variables with an auto option
+const DEFAULT_AUTO_COUNT = 30
+const DEFAULT_AUTO_MIN = "10s"
+
+// Works out the values of a dashboard's template variables, in order so a
+// query variable can refer to the ones before it. overrides, from the
+// report config, take precedence over what's selected in the dashboard.
+// Also returns the values to repeat rows and panels for, which differ when
+// All stands for a custom value like .*
+func resolveVariables(ctx context.Context, config Config, dashboard Dashboard,
+	overrides map[string][]string, dataSources *DataSources,
+	timeRange TimeRange) (map[string][]string, map[string][]string, error) {
+
+	vars := map[string][]string{}
+	repeats := map[string][]string{}
+	for _, variable := range dashboard.Templating.List {
+		values, err := resolveVariable(ctx, config, dashboard, variable,
+			overrides[variable.Name], vars, dataSources, timeRange)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error resolving variable '%s': %s", variable.Name, err)
+		}
+		vars[variable.Name] = values
+		repeats[variable.Name] = values
+
+		if variable.AllValue != "" && len(values) == 1 && values[0] == variable.AllValue {
+			repeats[variable.Name], err = variableOptions(ctx, config, dashboard, variable,
+				vars, dataSources, timeRange)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Error resolving variable '%s': %s", variable.Name, err)
+			}
+		}
+	}
+	return vars, repeats, nil
+}
+
+func resolveVariable(ctx context.Context, config Config, dashboard Dashboard,
+	variable TemplateVariable, override []string, vars map[string][]string,
+	dataSources *DataSources, timeRange TimeRange) ([]string, error) {
+
+	selected := override
+	if selected == nil {
+		if variable.Type == "constant" {
+			return []string{variable.Query}, nil
+		}
+		selected = []string(variable.Current.Value)
+	}
+
+	if variable.Type == "interval" && variable.Auto && len(selected) == 1 &&
+		(selected[0] == "auto" || strings.HasPrefix(selected[0], "$__auto_interval")) {
+		autoCount := variable.AutoCount
+		if autoCount <= 0 {
+			autoCount = DEFAULT_AUTO_COUNT
+		}
+		autoMin := variable.AutoMin
+		if autoMin == "" {
+			autoMin = DEFAULT_AUTO_MIN
+		}
+		interval, err := calculateInterval(timeRange, autoCount, autoMin)
+		if err != nil {
+			return nil, err
+		}
+		return []string{formatInterval(interval)}, nil
+	}
+
+	selectsAll := containsString(selected, ALL_VALUE)
+	if len(selected) > 0 && !selectsAll {
+		return selected, nil
+	}
+	if selectsAll && variable.AllValue != "" {
+		return []string{variable.AllValue}, nil
+	}
+
+	options, err := variableOptions(ctx, config, dashboard, variable, vars,
+		dataSources, timeRange)
+	if err != nil {
+		return nil, err
+	}
+	// With nothing selected, Grafana picks the first option, which is All
+	// if the variable has one
+	if !selectsAll && !variable.IncludeAll && len(options) > 0 {
+		return options[:1], nil
+	}
+	return options, nil
+}
+
+// Every value the variable could take, not counting All
+func variableOptions(ctx context.Context, config Config, dashboard Dashboard,
+	variable TemplateVariable, vars map[string][]string, dataSources *DataSources,
+	timeRange TimeRange) ([]string, error) {
+
+	switch variable.Type {
+	case "custom":
+		return splitCustomOptions(variable.Query), nil
+	case "interval":
+		return splitList(variable.Query), nil
+	case "constant", "textbox":
+		return []string{variable.Query}, nil
+	case "query":
+		dataSource, err := dataSources.Lookup(string(variable.DataSource))
+		if err != nil {
+			return nil, err
+		}
+		if dataSource.Type != "influxdb" {
+			log.Printf("Using saved options for variable '%s' since it's from a %s datasource",
+				variable.Name, dataSource.Type)
+			return savedOptions(variable), nil
+		}
+
+		interval, err := calculateInterval(timeRange, CHART_WIDTH, "")
+		if err != nil {
+			return nil, err
+		}
+		command := interpolateQuery(variable.Query, queryVariables(vars,
+			dashboard.Templating.List, timeRange.From, timeRange.To, interval))
+
+		queryCtx, cancel := context.WithTimeout(ctx, config.queryTimeout)
+		defer cancel()
+		values, err := queryValuesWithContext(queryCtx, dataSource.influxdbClient,
+			dataSource.Database, command)
+		if err != nil {
+			return nil, err
+		}
+		return filterVariableValues(values, variable.Regex)
+	default:
+		return savedOptions(variable), nil
+	}
+}
+
+func savedOptions(variable TemplateVariable) []string {
+	options := []string{}
+	for _, option := range variable.Options {
+		for _, value := range option.Value {
+			if value != ALL_VALUE {
+				options = append(options, value)
+			}
+		}
+	}
+	return options
+}
+
+// Splits a custom variable's comma-separated values, in which \, is a
+// literal comma
+func splitCustomOptions(query string) []string {
+	options := []string{}
+	current := ""
+	for i := 0; i < len(query); i++ {
+		if query[i] == '\\' && i+1 < len(query) && query[i+1] == ',' {
+			current += ","
+			i++
+		} else if query[i] == ',' {
+			options = append(options, strings.TrimSpace(current))
+			current = ""
+		} else {
+			current += string(query[i])
+		}
+	}
+	if strings.TrimSpace(current) != "" {
+		options = append(options, strings.TrimSpace(current))
+	}
+	return options
+}
+
+// Keeps values matching the variable's regex, written like /^web-(.*)/i;
+// if the regex has a group, the value becomes what the group matched
+func filterVariableValues(values []string, regex string) ([]string, error) {
+	if regex == "" {
+		return values, nil
+	}
+
+	compiled, err := compileSlashedRegex(regex)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []string{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		match := compiled.FindStringSubmatch(value)
+		if match == nil {
+			continue
+		}
+		if len(match) > 1 {
+			value = match[1]
+		}
+		if !seen[value] {
+			filtered = append(filtered, value)
+			seen[value] = true
+		}
+	}
+	return filtered, nil
+}
+
+// Compiles a regex written the JavaScript way, like /^web-(.*)/i, or
+// without the slashes
+func compileSlashedRegex(regex string) (*regexp.Regexp, error) {
+	pattern := regex
+	if strings.HasPrefix(regex, "/") && strings.LastIndex(regex, "/") > 0 {
+		end := strings.LastIndex(regex, "/")
+		pattern = regex[1:end]
+		if strings.Contains(regex[end+1:], "i") {
+			pattern = "(?i)" + pattern
+		}
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Bad regex '%s': %s", regex, err)
+	}
+	return compiled, nil
+}
+
+// One set of variables per value of the variable a row or panel repeats
+// for, each narrowed to that one value
+func repeatVariables(repeat string, vars map[string][]string,
+	repeats map[string][]string) []map[string][]string {
+
+	values, found := repeats[repeat]
+	if repeat == "" || !found || len(values) == 0 {
+		return []map[string][]string{vars}
+	}
+
+	repeated := []map[string][]string{}
+	for _, value := range values {
+		copied := map[string][]string{}
+		for name, values := range vars {
+			copied[name] = values
+		}
+		copied[repeat] = []string{value}
+		repeated = append(repeated, copied)
+	}
+	return repeated
+}
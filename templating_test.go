@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Custom and constant variables, as Grafana saves them, so none need a
+// datasource to resolve
+const TEMPLATED_DASHBOARD_JSON = `{
+  "title": "Servers",
+  "templating": {
+    "list": [
+      {"name": "host", "type": "custom", "multi": true, "includeAll": true,
+       "query": "web.1,web.2,a\\,b", "current": {"value": ["web.1"]}},
+      {"name": "env", "type": "custom", "multi": false, "includeAll": false,
+       "query": "prod.eu,prod.us", "current": {"value": "prod.eu"}},
+      {"name": "region", "type": "custom", "includeAll": true, "allValue": ".*",
+       "query": "us-east,eu-west", "current": {"value": "$__all"}},
+      {"name": "dc", "type": "constant", "query": "dc1"},
+      {"name": "empty", "type": "custom", "query": "x,y"}
+    ]
+  }
+}`
+
+func resolveTestVariables(t *testing.T,
+	overrides map[string][]string) (Dashboard, map[string][]string, map[string][]string) {
+
+	dashboard := Dashboard{}
+	if err := json.Unmarshal([]byte(TEMPLATED_DASHBOARD_JSON), &dashboard); err != nil {
+		t.Fatalf("Error from Unmarshal: %s", err)
+	}
+	timeRange := TimeRange{From: time.Unix(1600000000, 0), To: time.Unix(1600086400, 0)}
+	vars, repeats, err := resolveVariables(context.Background(), Config{}, dashboard,
+		overrides, nil, timeRange)
+	if err != nil {
+		t.Fatalf("Error from resolveVariables: %s", err)
+	}
+	return dashboard, vars, repeats
+}
+
+func TestResolveVariables(t *testing.T) {
+	_, vars, repeats := resolveTestVariables(t, map[string][]string{"env": {"staging"}})
+
+	expected := map[string][]string{
+		"host":   {"web.1"},
+		"env":    {"staging"},
+		"region": {".*"},
+		"dc":     {"dc1"},
+		"empty":  {"x"}, // nothing selected, so the first option
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected vars %v but got %v", expected, vars)
+	}
+	if !reflect.DeepEqual(repeats["region"], []string{"us-east", "eu-west"}) {
+		t.Errorf("Expected to repeat for every region but got %v", repeats["region"])
+	}
+	if !reflect.DeepEqual(repeats["host"], []string{"web.1"}) {
+		t.Errorf("Expected to repeat for the selected host but got %v", repeats["host"])
+	}
+}
+
+func TestResolveVariablesAll(t *testing.T) {
+	_, vars, _ := resolveTestVariables(t, map[string][]string{"host": {ALL_VALUE}})
+	if !reflect.DeepEqual(vars["host"], []string{"web.1", "web.2", "a,b"}) {
+		t.Errorf("Expected every host but got %v", vars["host"])
+	}
+}
+
+func TestResolvedVariablesInQuery(t *testing.T) {
+	dashboard, vars, _ := resolveTestVariables(t, nil)
+	queryVars := queryVariables(vars, dashboard.Templating.List,
+		time.Unix(1600000000, 0), time.Unix(1600086400, 0), time.Minute)
+
+	actual := interpolateQuery(
+		`SELECT * FROM cpu WHERE host =~ /^$host$/ AND env = '$env' AND region =~ /^$region$/`,
+		queryVars)
+	expected := `SELECT * FROM cpu WHERE host =~ /^web\.1$/ AND env = 'prod.eu' AND region =~ /^.*$/`
+	if actual != expected {
+		t.Errorf("Got %s\nexpected %s", actual, expected)
+	}
+}
+
+func TestRepeatVariables(t *testing.T) {
+	vars := map[string][]string{"host": {".*"}, "env": {"prod"}}
+	repeats := map[string][]string{"host": {"web-1", "web-2"}, "env": {"prod"}}
+
+	repeated := repeatVariables("host", vars, repeats)
+	expected := []map[string][]string{
+		{"host": {"web-1"}, "env": {"prod"}},
+		{"host": {"web-2"}, "env": {"prod"}},
+	}
+	if !reflect.DeepEqual(repeated, expected) {
+		t.Errorf("Expected %v but got %v", expected, repeated)
+	}
+	if vars["host"][0] != ".*" {
+		t.Errorf("Expected the original vars to be left alone but got %v", vars)
+	}
+
+	for _, repeat := range []string{"", "missing"} {
+		if repeated := repeatVariables(repeat, vars, repeats); len(repeated) != 1 ||
+			!reflect.DeepEqual(repeated[0], vars) {
+			t.Errorf("Repeat %q: expected vars unchanged but got %v", repeat, repeated)
+		}
+	}
+}
+
+func TestSplitCustomOptions(t *testing.T) {
+	tests := map[string][]string{
+		"a, b ,c":       {"a", "b", "c"},
+		`1\,000,2\,000`: {"1,000", "2,000"},
+		"only":          {"only"},
+		"":              {},
+	}
+	for query, expected := range tests {
+		if actual := splitCustomOptions(query); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("splitCustomOptions(%q) = %v, expected %v", query, actual, expected)
+		}
+	}
+}
+
+func TestFilterVariableValues(t *testing.T) {
+	values := []string{"web-1.prod", "web-2.prod", "db-1.prod", "WEB-1.staging"}
+	tests := []struct {
+		regex    string
+		expected []string
+	}{
+		{"", values},
+		{"/^web/", []string{"web-1.prod", "web-2.prod"}},
+		{"/^web-(\\d+)/i", []string{"1", "2"}},
+		{"prod$", []string{"web-1.prod", "web-2.prod", "db-1.prod"}},
+	}
+	for _, test := range tests {
+		actual, err := filterVariableValues(values, test.regex)
+		if err != nil {
+			t.Errorf("%s: error from filterVariableValues: %s", test.regex, err)
+		} else if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: expected %v but got %v", test.regex, test.expected, actual)
+		}
+	}
+
+	if _, err := filterVariableValues(values, "/(/"); err == nil {
+		t.Errorf("Expected an error for a bad regex")
+	}
+}
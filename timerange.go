@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TimeRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// Layouts accepted for absolute times, in addition to Unix milliseconds
+var ABSOLUTE_TIME_LAYOUTS = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"20060102T150405",
+	"2006-01-02",
+}
+
+func parseTimeRange(from, to string, now time.Time) (TimeRange, error) {
+	fromTime, err := parseTimeExpression(from, now, false)
+	if err != nil {
+		return TimeRange{}, fmt.Errorf("Invalid from time '%s': %s", from, err)
+	}
+	toTime, err := parseTimeExpression(to, now, true)
+	if err != nil {
+		return TimeRange{}, fmt.Errorf("Invalid to time '%s': %s", to, err)
+	}
+	if !fromTime.Before(toTime) {
+		return TimeRange{}, fmt.Errorf("From time '%s' (%s) isn't before to time '%s' (%s)",
+			from, fromTime, to, toTime)
+	}
+	return TimeRange{From: fromTime, To: toTime}, nil
+}
+
+// Parses Grafana's date math, e.g. now-7d, now-1d/d, now/w, or an absolute
+// time.  Rounding (the /unit suffix) goes to the start of the unit, or to
+// its end if roundUp is set, which is how Grafana treats the "to" time.
+func parseTimeExpression(expr string, now time.Time, roundUp bool) (time.Time, error) {
+	expr = strings.TrimSpace(expr)
+	if !strings.HasPrefix(expr, "now") {
+		return parseAbsoluteTime(expr, now.Location())
+	}
+
+	t := now
+	rest := expr[len("now"):]
+	for rest != "" {
+		op := rest[0]
+		rest = rest[1:]
+		if op != '+' && op != '-' && op != '/' {
+			return time.Time{}, fmt.Errorf("Unexpected '%c'", op)
+		}
+
+		numDigits := 0
+		for numDigits < len(rest) && rest[numDigits] >= '0' && rest[numDigits] <= '9' {
+			numDigits++
+		}
+		amount := 1
+		if numDigits > 0 {
+			if op == '/' {
+				return time.Time{}, fmt.Errorf("Rounding can't have a number")
+			}
+			amount, _ = strconv.Atoi(rest[:numDigits])
+			rest = rest[numDigits:]
+		}
+
+		if rest == "" {
+			return time.Time{}, fmt.Errorf("Missing unit after '%c'", op)
+		}
+		unit := rest[0]
+		rest = rest[1:]
+
+		var err error
+		if op == '/' {
+			t, err = roundTime(t, unit, roundUp)
+		} else if op == '-' {
+			t, err = addTimeUnits(t, -amount, unit)
+		} else {
+			t, err = addTimeUnits(t, amount, unit)
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return t, nil
+}
+
+func parseAbsoluteTime(expr string, location *time.Location) (time.Time, error) {
+	if millis, err := strconv.ParseInt(expr, 10, 64); err == nil && len(expr) > 8 {
+		return time.Unix(0, millis*UNIX_MILLIS_TO_UNIX_NANOS).In(location), nil
+	}
+	for _, layout := range ABSOLUTE_TIME_LAYOUTS {
+		if t, err := time.ParseInLocation(layout, expr, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Expected now-based expression or absolute time")
+}
+
+func addTimeUnits(t time.Time, amount int, unit byte) (time.Time, error) {
+	switch unit {
+	case 'y':
+		return t.AddDate(amount, 0, 0), nil
+	case 'M':
+		return t.AddDate(0, amount, 0), nil
+	case 'w':
+		return t.AddDate(0, 0, 7*amount), nil
+	case 'd':
+		return t.AddDate(0, 0, amount), nil
+	case 'h':
+		return t.Add(time.Duration(amount) * time.Hour), nil
+	case 'm':
+		return t.Add(time.Duration(amount) * time.Minute), nil
+	case 's':
+		return t.Add(time.Duration(amount) * time.Second), nil
+	default:
+		return time.Time{}, fmt.Errorf("Unknown time unit '%c'", unit)
+	}
+}
+
+func roundTime(t time.Time, unit byte, roundUp bool) (time.Time, error) {
+	location := t.Location()
+	var start time.Time
+	switch unit {
+	case 'y':
+		start = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, location)
+	case 'M':
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location)
+	case 'w':
+		// Weeks start on Sunday, like in Grafana's default locale
+		start = time.Date(t.Year(), t.Month(), t.Day()-int(t.Weekday()),
+			0, 0, 0, 0, location)
+	case 'd':
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	case 'h':
+		start = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, location)
+	case 'm':
+		start = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(),
+			0, 0, location)
+	case 's':
+		start = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(),
+			t.Second(), 0, location)
+	default:
+		return time.Time{}, fmt.Errorf("Unknown time unit '%c'", unit)
+	}
+
+	if !roundUp {
+		return start, nil
+	}
+	end, err := addTimeUnits(start, 1, unit)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return end.Add(-time.Millisecond), nil
+}
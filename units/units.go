@@ -0,0 +1,156 @@
+// Formats numbers in Grafana's units, e.g. 1536 bytes as "1.5 KiB", for
+// axis tick labels, stats, tables and summaries alike
+package units
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A unit that scales by factor, e.g. bytes by 1024 into KiB, MiB and so on
+type ScaledUnit struct {
+	factor   float64
+	suffixes []string
+}
+
+// Grafana's unit names, as in a y axis' format or a stat's unit
+var SCALED_UNITS = map[string]ScaledUnit{
+	"short": {1000, []string{"", " K", " Mil", " Bil", " Tri", " Quadr", " Quint", " Sext", " Sept"}},
+
+	"bytes":    {1024, []string{" B", " KiB", " MiB", " GiB", " TiB", " PiB", " EiB"}},
+	"kbytes":   {1024, []string{" KiB", " MiB", " GiB", " TiB", " PiB", " EiB"}},
+	"mbytes":   {1024, []string{" MiB", " GiB", " TiB", " PiB", " EiB"}},
+	"gbytes":   {1024, []string{" GiB", " TiB", " PiB", " EiB"}},
+	"decbytes": {1000, []string{" B", " kB", " MB", " GB", " TB", " PB", " EB"}},
+	"bits":     {1024, []string{" b", " Kib", " Mib", " Gib", " Tib", " Pib", " Eib"}},
+	"decbits":  {1000, []string{" b", " kb", " Mb", " Gb", " Tb", " Pb", " Eb"}},
+
+	"bps":   {1000, []string{" bps", " Kbps", " Mbps", " Gbps", " Tbps", " Pbps"}},
+	"Bps":   {1000, []string{" B/s", " kB/s", " MB/s", " GB/s", " TB/s", " PB/s"}},
+	"KBs":   {1000, []string{" kB/s", " MB/s", " GB/s", " TB/s", " PB/s"}},
+	"MBs":   {1000, []string{" MB/s", " GB/s", " TB/s", " PB/s"}},
+	"pps":   {1000, []string{" p/s", " Kp/s", " Mp/s", " Gp/s"}},
+	"ops":   {1000, []string{" ops", " K ops", " Mil ops", " Bil ops"}},
+	"reqps": {1000, []string{" req/s", " K req/s", " Mil req/s", " Bil req/s"}},
+	"rps":   {1000, []string{" rd/s", " K rd/s", " Mil rd/s", " Bil rd/s"}},
+	"wps":   {1000, []string{" wr/s", " K wr/s", " Mil wr/s", " Bil wr/s"}},
+	"iops":  {1000, []string{" io/s", " K io/s", " Mil io/s", " Bil io/s"}},
+	"hertz": {1000, []string{" Hz", " kHz", " MHz", " GHz", " THz"}},
+}
+
+// A duration unit and its length in seconds
+type TimeUnit struct {
+	name    string
+	seconds float64
+}
+
+// Shortest first; durations are shown in the longest unit they fill
+var TIME_UNITS = []TimeUnit{
+	{" ns", 1e-9},
+	{" µs", 1e-6},
+	{" ms", 1e-3},
+	{" s", 1},
+	{" min", 60},
+	{" hour", 3600},
+	{" day", 86400},
+	{" week", 604800},
+	{" year", 31536000},
+}
+
+// Grafana's names for the time formats, and what a value of 1 is in seconds
+var TIME_FORMATS = map[string]float64{
+	"ns": 1e-9,
+	"µs": 1e-6,
+	"us": 1e-6,
+	"ms": 1e-3,
+	"s":  1,
+	"m":  60,
+	"h":  3600,
+	"d":  86400,
+}
+
+// Formats a value in one of Grafana's units, e.g. 1536 as bytes is
+// "1.5 KiB". decimals < 0 picks a number of decimals to suit the value.
+// Unknown units, and none, show the plain number.
+func Format(value float64, unit string, decimals int) string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	if scaledUnit, ok := SCALED_UNITS[unit]; ok {
+		scaled, suffix := scaleValue(value, scaledUnit)
+		return formatDecimals(scaled, decimals) + suffix
+	}
+
+	if seconds, ok := TIME_FORMATS[unit]; ok {
+		return formatDuration(value*seconds, seconds, decimals)
+	}
+
+	switch unit {
+	case "percent":
+		return formatDecimals(value, decimals) + "%"
+	case "percentunit":
+		return formatDecimals(value*100, decimals) + "%"
+	}
+
+	if decimals < 0 {
+		return formatPlain(value)
+	}
+	return formatDecimals(value, decimals)
+}
+
+func scaleValue(value float64, unit ScaledUnit) (float64, string) {
+	i := 0
+	for math.Abs(value) >= unit.factor && i < len(unit.suffixes)-1 {
+		value /= unit.factor
+		i += 1
+	}
+	return value, unit.suffixes[i]
+}
+
+// Shows seconds in the longest unit it fills, e.g. 90 as "1.5 min"; zero
+// stays in the format's own unit
+func formatDuration(seconds, formatSeconds float64, decimals int) string {
+	unit := TIME_UNITS[0]
+	for _, candidate := range TIME_UNITS {
+		if (seconds == 0 && candidate.seconds == formatSeconds) ||
+			(seconds != 0 && math.Abs(seconds) >= candidate.seconds) {
+			unit = candidate
+		}
+	}
+	return formatDecimals(seconds/unit.seconds, decimals) + unit.name
+}
+
+// Formats with up to 3 decimal places, e.g. 12.5 rather than 12.500
+func formatPlain(value float64) string {
+	formatted := strconv.FormatFloat(value, 'f', 3, 64)
+	formatted = strings.TrimRight(formatted, "0")
+	return strings.TrimSuffix(formatted, ".")
+}
+
+// With decimals < 0, more decimals for smaller numbers, without trailing
+// zeros, e.g. 123, 12.3, 1.23 and 0.0012
+func formatDecimals(value float64, decimals int) string {
+	if decimals >= 0 {
+		return strconv.FormatFloat(value, 'f', decimals, 64)
+	}
+
+	decimals = 2
+	if math.Abs(value) >= 100 {
+		decimals = 0
+	} else if math.Abs(value) >= 10 {
+		decimals = 1
+	} else if value != 0 && math.Abs(value) < 0.1 { // at least 2 significant digits
+		decimals = int(-math.Floor(math.Log10(math.Abs(value)))) + 1
+	}
+	formatted := strconv.FormatFloat(value, 'f', decimals, 64)
+	if strings.Contains(formatted, ".") {
+		formatted = strings.TrimRight(formatted, "0")
+		formatted = strings.TrimSuffix(formatted, ".")
+	}
+	if formatted == "-0" {
+		formatted = "0"
+	}
+	return formatted
+}
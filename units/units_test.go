@@ -0,0 +1,55 @@
+package units
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		value    float64
+		unit     string
+		decimals int
+		expected string
+	}{
+		{1536, "bytes", -1, "1.5 KiB"},
+		{1536, "bytes", 2, "1.50 KiB"},
+		{512, "bytes", -1, "512 B"},
+		{3 * 1024 * 1024, "kbytes", -1, "3 GiB"},
+		{1500, "decbytes", -1, "1.5 kB"},
+		{2500000, "bps", -1, "2.5 Mbps"},
+		{1234, "short", -1, "1.23 K"},
+		{12, "short", -1, "12"},
+		{-2048, "bytes", 0, "-2 KiB"},
+		{0.25, "percentunit", -1, "25%"},
+		{99.5, "percent", 0, "100%"},
+		{90, "s", -1, "1.5 min"},
+		{0.5, "s", -1, "500 ms"},
+		{0, "ms", -1, "0 ms"},
+		{7200000, "ms", -1, "2 hour"},
+		{3, "d", -1, "3 day"},
+		{14, "d", -1, "2 week"},
+		{12.5, "", -1, "12.5"},
+		{12.5, "none", 2, "12.50"},
+		{0.0012345, "", -1, "0.001"},
+		{0.0012345, "short", -1, "0.0012"},
+		{-0.0001, "short", -1, "-0.0001"},
+		{123456, "unknown", -1, "123456"},
+	}
+	for _, test := range tests {
+		actual := Format(test.value, test.unit, test.decimals)
+		if actual != test.expected {
+			t.Errorf("Format(%v, %q, %d) = %q, expected %q",
+				test.value, test.unit, test.decimals, actual, test.expected)
+		}
+	}
+}
+
+func TestFormatNotFinite(t *testing.T) {
+	if actual := Format(math.NaN(), "bytes", -1); actual != "NaN" {
+		t.Errorf("Expected NaN but got %q", actual)
+	}
+	if actual := Format(math.Inf(1), "bytes", -1); actual != "+Inf" {
+		t.Errorf("Expected +Inf but got %q", actual)
+	}
+}